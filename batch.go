@@ -0,0 +1,144 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"context"
+	"sort"
+)
+
+// NearestBatch is like calling Nearest for each of ps, but searches for all of
+// them at once so that each node is read once for every group of queries
+// that reaches it together rather than once per query. Result i is for ps[i].
+func (t *Tree) NearestBatch(ps []Point, n int) ([][]PointDistance, error) {
+	return t.NearestBatchWithOptions(ps, n, nil)
+}
+
+// NearestBatchWithOptions is like NearestBatch but allows for configuring the
+// searches. A nil opts is the same as NearestBatch.
+func (t *Tree) NearestBatchWithOptions(ps []Point, n int,
+	opts *SearchOptions) ([][]PointDistance, error) {
+	return t.NearestBatchContext(context.Background(), ps, n, opts)
+}
+
+// NearestBatchContext is like NearestBatchWithOptions but stops early if ctx
+// is done, returning ctx.Err(). Approximate searches, which visit nodes in a
+// different order for every query, are run one query at a time.
+func (t *Tree) NearestBatchContext(ctx context.Context, ps []Point, n int,
+	opts *SearchOptions) ([][]PointDistance, error) {
+	rv := make([][]PointDistance, len(ps))
+	if opts.approximate() {
+		for i, p := range ps {
+			var err error
+			rv[i], err = t.NearestContext(ctx, p, n, opts)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return rv, nil
+	}
+
+	batch := make([]*batchQuery, 0, len(ps))
+	for _, p := range ps {
+		q, err := t.newQuery(ctx, p, opts)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, &batchQuery{q: q, h: make(maxHeap, 0, n)})
+	}
+	if n > 0 {
+		err := t.searchBatch(t.root, batch)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, bq := range batch {
+		sort.Sort(sort.Reverse(&bq.h))
+		rv[i] = bq.h
+	}
+	return rv, nil
+}
+
+// batchQuery is a single query in a batch, along with its results so far.
+type batchQuery struct {
+	q *query
+	h maxHeap
+}
+
+// needs returns whether bq could still find a result bound away.
+func (bq *batchQuery) needs(bound float64) bool {
+	return bq.h.Len() < bq.h.Cap() || bound <= bq.h.Max().Distance
+}
+
+// farQuery is a query waiting to search the far side of a node.
+type farQuery struct {
+	bq    *batchQuery
+	bound float64
+}
+
+// searchBatch is like search, but for a group of queries that all need the
+// node at node_offset. Queries are split by which child is near to them.
+// Queries that are near the left child search it first. The right child is
+// then searched by the queries near it together with the queries that still
+// need it as their far side, leaving the left child to be searched a second
+// time only by the queries that still need it as their far side.
+func (t *Tree) searchBatch(node_offset int64, batch []*batchQuery) error {
+	if node_offset == -1 || len(batch) == 0 {
+		return nil
+	}
+
+	n, err := t.visit(batch[0].q, node_offset)
+	if err != nil {
+		return err
+	}
+
+	var nearLeft, nearRight []*batchQuery
+	var farLeft, farRight []farQuery
+	for _, bq := range batch {
+		t.offer(bq.q, &bq.h, node_offset, &n)
+		near, _, farBound := bq.q.split(&n)
+		if near == n.Left {
+			nearLeft = append(nearLeft, bq)
+			farRight = append(farRight, farQuery{bq: bq, bound: farBound})
+		} else {
+			nearRight = append(nearRight, bq)
+			farLeft = append(farLeft, farQuery{bq: bq, bound: farBound})
+		}
+	}
+
+	err = t.searchBatch(n.Left, nearLeft)
+	if err != nil {
+		return err
+	}
+
+	right := nearRight
+	for _, fq := range farRight {
+		if fq.bq.needs(fq.bound) {
+			right = append(right, fq.bq)
+		}
+	}
+	err = t.searchBatch(n.Right, right)
+	if err != nil {
+		return err
+	}
+
+	var left []*batchQuery
+	for _, fq := range farLeft {
+		if fq.bq.needs(fq.bound) {
+			left = append(left, fq.bq)
+		}
+	}
+	return t.searchBatch(n.Left, left)
+}
@@ -0,0 +1,406 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/spacemonkeygo/errors"
+)
+
+const (
+	// subtrees with fewer points than this are always built by the worker
+	// that split them, as handing them off costs more than it saves.
+	minParallelPoints = 1024
+)
+
+// SplitStrategy determines which point each subtree is split around.
+type SplitStrategy int
+
+const (
+	// SplitSampled splits around the median of a random sample of the
+	// subtree's points. It is the fastest strategy, but can produce unbalanced
+	// trees on skewed data.
+	SplitSampled SplitStrategy = iota
+
+	// SplitExact splits around the exact median, found with repeated passes
+	// over the subtree's points.
+	SplitExact
+
+	// SplitMidpoint splits around the point closest to the middle of the
+	// subtree's range along the split dimension (a sliding midpoint).
+	SplitMidpoint
+)
+
+// DimStrategy determines which dimension each subtree is split along.
+type DimStrategy int
+
+const (
+	// DimRoundRobin cycles through the dimensions, one per level of the
+	// tree.
+	DimRoundRobin DimStrategy = iota
+
+	// DimMaxVariance splits along the dimension in which the subtree's
+	// points have the largest variance.
+	DimMaxVariance
+
+	// DimMaxRange splits along the dimension in which the subtree's points
+	// have the largest range.
+	DimMaxRange
+)
+
+// BuildOptions control how CreateTreeWithOptions builds a tree.
+type BuildOptions struct {
+	// Workers is the maximum number of subtrees to build concurrently.
+	// Values less than 1 mean 1.
+	Workers int
+
+	// MemoryBudget is the approximate number of bytes of points a worker may
+	// load into memory at once. Once a subtree's points fit within the
+	// budget, the rest of that subtree is built in memory instead of
+	// splitting it into temporary files at every level. Zero disables
+	// in-memory building.
+	MemoryBudget int64
+
+	// Split determines which point each subtree is split around.
+	Split SplitStrategy
+
+	// SampleSize is the number of points sampled from each subtree to
+	// estimate its median with SplitSampled or to pick pivots with
+	// SplitExact. Zero means 100.
+	SampleSize int
+
+	// SplitDim determines which dimension each subtree is split along.
+	SplitDim DimStrategy
+
+	// BucketSize, if at least 2, stores subtrees of up to BucketSize points
+	// as a single leaf node, the points of which are scanned linearly during
+	// searches. This reduces the number of nodes and the random reads needed
+	// to search.
+	BucketSize int
+
+	// Normalize scales every point to unit length before building, which
+	// allows searching the tree by cosine similarity with NearestCosine.
+	// Points in a normalized tree are returned normalized, and zero-length
+	// points are rejected.
+	Normalize bool
+}
+
+// builder builds a tree out of a PointSet into a set of node logs, one per
+// worker.
+type builder struct {
+	ctx              context.Context
+	fs               *baseFS
+	dims, maxDataLen int
+	opts             BuildOptions
+
+	// next is the end of the space reserved so far by all node logs.
+	next int64
+
+	// idle workers wait to receive from tasks. it is unbuffered, so a send
+	// only succeeds if a worker is free to take the task right away.
+	tasks chan *buildTask
+	wg    sync.WaitGroup
+
+	mtx          sync.Mutex
+	logs         []*nodeLog
+	depth        int
+	nodes, count int64
+}
+
+type buildTask struct {
+	points *PointSet
+	dim    int
+	depth  int
+	offset int64
+	err    error
+	done   chan struct{}
+}
+
+func newBuilder(ctx context.Context, fs *baseFS, dims, maxDataLen int,
+	opts BuildOptions) *builder {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.SampleSize <= 0 {
+		opts.SampleSize = samplingSize
+	}
+	if opts.BucketSize < 2 {
+		opts.BucketSize = 0
+	}
+	return &builder{
+		ctx:        ctx,
+		fs:         fs,
+		dims:       dims,
+		maxDataLen: maxDataLen,
+		opts:       opts,
+		tasks:      make(chan *buildTask),
+	}
+}
+
+func (b *builder) newLog() (*nodeLog, error) {
+	nl, err := newNodeLog(b.fs.Temp(), b.dims, b.maxDataLen,
+		b.opts.BucketSize > 0, &b.next)
+	if err != nil {
+		return nil, err
+	}
+	b.mtx.Lock()
+	b.logs = append(b.logs, nl)
+	b.mtx.Unlock()
+	return nl, nil
+}
+
+// Build builds the whole tree out of points and returns the paths of the
+// resulting node logs.
+func (b *builder) Build(points *PointSet) (paths []string, err error) {
+	nl, err := b.newLog()
+	if err != nil {
+		points.Close()
+		return nil, err
+	}
+
+	for i := 1; i < b.opts.Workers && err == nil; i++ {
+		var wnl *nodeLog
+		wnl, err = b.newLog()
+		if err == nil {
+			b.wg.Add(1)
+			go b.worker(wnl)
+		}
+	}
+
+	if err == nil && b.opts.Normalize {
+		points, err = points.normalized(b.ctx, b.fs)
+	}
+
+	if err == nil && points.sampleSize != b.opts.SampleSize &&
+		b.opts.Split != SplitMidpoint {
+		err = points.resample(b.ctx, b.opts.SampleSize)
+	}
+
+	if err == nil {
+		_, err = b.build(nl, points, 0, 1)
+	} else {
+		points.Close()
+	}
+	close(b.tasks)
+	b.wg.Wait()
+
+	var errs errors.ErrorGroup
+	errs.Add(err)
+	for _, nl := range b.logs {
+		errs.Add(nl.Close())
+		paths = append(paths, nl.path)
+	}
+	return paths, errs.Finalize()
+}
+
+func (b *builder) worker(nl *nodeLog) {
+	defer b.wg.Done()
+	for task := range b.tasks {
+		task.offset, task.err = b.build(nl, task.points, task.dim, task.depth)
+		close(task.done)
+	}
+}
+
+// header returns a tree file header describing the build.
+func (b *builder) header() header {
+	h := newHeader(b.dims, b.maxDataLen, b.opts.BucketSize)
+	h.SampleSize = uint32(b.opts.SampleSize)
+	h.Split = uint32(b.opts.Split)
+	h.SplitDim = uint32(b.opts.SplitDim)
+	h.Depth = uint32(b.depth)
+	h.Count = b.nodes
+	h.Points = b.count
+	if b.opts.Normalize {
+		h.Normalized = 1
+	}
+	return h
+}
+
+// visit records that a node with the given number of points was added at the
+// given depth.
+func (b *builder) visit(depth, points int) {
+	b.mtx.Lock()
+	if depth > b.depth {
+		b.depth = depth
+	}
+	b.nodes++
+	b.count += int64(points)
+	b.mtx.Unlock()
+}
+
+// splitPoint picks the point to split log around along dim.
+func (b *builder) splitPoint(log *PointSet, dim int) (Point, error) {
+	switch b.opts.Split {
+	case SplitExact:
+		return log.exactMedian(b.ctx, dim)
+	case SplitMidpoint:
+		return log.closestTo(b.ctx, dim,
+			(log.spread.min[dim]+log.spread.max[dim])/2)
+	default:
+		return log.medianEstimate(dim), nil
+	}
+}
+
+// splitIndex is like splitPoint, but for points already sorted along dim.
+// Points equal to the split point along dim come before it, like in
+// PointSet.split.
+func (b *builder) splitIndex(points []Point, dim int) int {
+	mid := len(points) / 2
+	if b.opts.Split == SplitMidpoint {
+		target := (points[0].Pos[dim] + points[len(points)-1].Pos[dim]) / 2
+		mid = sort.Search(len(points), func(i int) bool {
+			return points[i].Pos[dim] >= target
+		})
+		if mid == len(points) || mid > 0 &&
+			target-points[mid-1].Pos[dim] < points[mid].Pos[dim]-target {
+			mid--
+		}
+	}
+	for mid+1 < len(points) && points[mid+1].Pos[dim] == points[mid].Pos[dim] {
+		mid++
+	}
+	return mid
+}
+
+// spawn builds the subtree for points, on an idle worker if there is one or
+// right away if not.
+func (b *builder) spawn(nl *nodeLog, points *PointSet, dim, depth int) (
+	task *buildTask) {
+	task = &buildTask{points: points, dim: dim, depth: depth,
+		done: make(chan struct{})}
+	if points.count >= minParallelPoints {
+		select {
+		case b.tasks <- task:
+			return task
+		default:
+		}
+	}
+	task.offset, task.err = b.build(nl, points, dim, depth)
+	close(task.done)
+	return task
+}
+
+func (b *builder) build(nl *nodeLog, log *PointSet, dim, depth int) (
+	node_offset int64, err error) {
+	defer log.Close()
+	if log.count == 0 {
+		return -1, nil
+	}
+
+	err = b.ctx.Err()
+	if err != nil {
+		return -1, err
+	}
+
+	if log.count <= int64(b.opts.BucketSize) ||
+		log.count*int64(pointSize(b.dims, b.maxDataLen)) <=
+			b.opts.MemoryBudget {
+		points, err := log.load(b.ctx)
+		if err != nil {
+			return -1, err
+		}
+		return b.buildMemory(nl, points, dim, depth)
+	}
+
+	dim = log.spread.widest(b.opts.SplitDim, dim)
+	median, err := b.splitPoint(log, dim)
+	if err != nil {
+		return -1, err
+	}
+	left, right, err := log.split(b.ctx, b.fs, median, dim, true)
+	if err != nil {
+		return -1, err
+	}
+
+	defer left.Close()
+	defer right.Close()
+
+	ndim := (dim + 1) % log.dims
+
+	leftTask := b.spawn(nl, left, ndim, depth+1)
+	rightOffset, err := b.build(nl, right, ndim, depth+1)
+	<-leftTask.done
+	if leftTask.err != nil {
+		return -1, leftTask.err
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	b.visit(depth, 1)
+	return nl.Add(Node{
+		Point: median,
+		Dim:   uint32(dim),
+		Left:  leftTask.offset,
+		Right: rightOffset})
+}
+
+// buildMemory is like build, but for points already in memory. points is
+// reordered in the process.
+func (b *builder) buildMemory(nl *nodeLog, points []Point, dim, depth int) (
+	node_offset int64, err error) {
+	if len(points) == 0 {
+		return -1, nil
+	}
+
+	err = b.ctx.Err()
+	if err != nil {
+		return -1, err
+	}
+
+	if len(points) <= b.opts.BucketSize {
+		b.visit(depth, len(points))
+		return nl.Add(Node{
+			Point:  points[0],
+			Bucket: points[1:],
+			Dim:    uint32(dim),
+			Left:   -1,
+			Right:  -1})
+	}
+
+	if b.opts.SplitDim != DimRoundRobin {
+		var s spread
+		for _, p := range points {
+			s.add(p.Pos)
+		}
+		dim = s.widest(b.opts.SplitDim, dim)
+	}
+
+	sort.Sort(&pointSorter{Dim: dim, Points: points})
+
+	mid := b.splitIndex(points, dim)
+
+	ndim := (dim + 1) % b.dims
+
+	leftOffset, err := b.buildMemory(nl, points[:mid], ndim, depth+1)
+	if err != nil {
+		return -1, err
+	}
+
+	rightOffset, err := b.buildMemory(nl, points[mid+1:], ndim, depth+1)
+	if err != nil {
+		return -1, err
+	}
+
+	b.visit(depth, 1)
+	return nl.Add(Node{
+		Point: points[mid],
+		Dim:   uint32(dim),
+		Left:  leftOffset,
+		Right: rightOffset})
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// CacheStats counts how Tree.Node calls were served by the node cache.
+type CacheStats struct {
+	// Hits is the number of nodes found in the cache, pinned or not.
+	Hits int64
+
+	// Misses is the number of nodes that had to be read from the file.
+	Misses int64
+
+	// Bytes is the serialized size of the unpinned nodes currently cached.
+	Bytes int64
+}
+
+// nodeCache holds parsed nodes so that queries don't have to read and parse
+// them again. Pinned nodes are loaded when the tree is opened and never
+// evicted. Other nodes are kept in least recently used order until their
+// total size exceeds maxBytes.
+type nodeCache struct {
+	hits, misses int64
+
+	pinned map[int64]Node
+
+	mtx      sync.Mutex
+	maxBytes int64
+	bytes    int64
+	lru      *list.List
+	entries  map[int64]*list.Element
+}
+
+type cacheEntry struct {
+	offset int64
+	node   Node
+	size   int64
+}
+
+func newNodeCache(maxBytes int64) *nodeCache {
+	return &nodeCache{
+		pinned:   map[int64]Node{},
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[int64]*list.Element{},
+	}
+}
+
+func (c *nodeCache) get(offset int64) (Node, bool) {
+	if n, ok := c.pinned[offset]; ok {
+		atomic.AddInt64(&c.hits, 1)
+		return n, true
+	}
+	if c.maxBytes > 0 {
+		c.mtx.Lock()
+		e, ok := c.entries[offset]
+		if ok {
+			c.lru.MoveToFront(e)
+		}
+		c.mtx.Unlock()
+		if ok {
+			atomic.AddInt64(&c.hits, 1)
+			return e.Value.(*cacheEntry).node, true
+		}
+	}
+	atomic.AddInt64(&c.misses, 1)
+	return Node{}, false
+}
+
+// add caches n, evicting the least recently used nodes to make room. Nodes
+// bigger than the whole cache aren't cached.
+func (c *nodeCache) add(offset int64, n Node, size int64) {
+	if size > c.maxBytes {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.entries[offset]; ok {
+		return
+	}
+	for c.bytes+size > c.maxBytes {
+		e := c.lru.Back()
+		ce := c.lru.Remove(e).(*cacheEntry)
+		delete(c.entries, ce.offset)
+		c.bytes -= ce.size
+	}
+	c.entries[offset] = c.lru.PushFront(&cacheEntry{
+		offset: offset,
+		node:   n,
+		size:   size})
+	c.bytes += size
+}
+
+func (c *nodeCache) stats() CacheStats {
+	c.mtx.Lock()
+	bytes := c.bytes
+	c.mtx.Unlock()
+	return CacheStats{
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+		Bytes:  bytes,
+	}
+}
+
+// pin loads the top levels of t into the cache for good.
+func (c *nodeCache) pin(t *Tree, levels int) error {
+	frontier := []int64{t.root}
+	for level := 0; level < levels; level++ {
+		var next []int64
+		for _, offset := range frontier {
+			if offset == -1 {
+				continue
+			}
+			n, err := t.readNode(offset)
+			if err != nil {
+				return err
+			}
+			c.pinned[offset] = n
+			next = append(next, n.Left, n.Right)
+		}
+		frontier = next
+	}
+	return nil
+}
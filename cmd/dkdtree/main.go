@@ -0,0 +1,443 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command dkdtree builds, queries and inspects dkdtree files.
+//
+// Usage:
+//
+//	dkdtree build -dims N [flags] <input> <tree>
+//	dkdtree query [flags] <tree> < queries
+//	dkdtree info <tree>
+//	dkdtree dump [flags] <tree>
+//
+// Run a subcommand with -h for its flags.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jtolds/dkdtree"
+)
+
+// errUsage is returned by commands when they were invoked incorrectly, after
+// they have printed their usage.
+var errUsage = errors.New("invalid usage")
+
+// commands run a subcommand with the arguments after its name.
+var commands = map[string]func(args []string, stdin io.Reader,
+	stdout io.Writer) error{
+	"build": build,
+	"query": query,
+	"info":  info,
+	"dump":  dump,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <build|query|info|dump> [flags] ...\n",
+		filepath.Base(os.Args[0]))
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	err := cmd(os.Args[2:], os.Stdin, os.Stdout)
+	if err == errUsage {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: %v\n", filepath.Base(os.Args[0]),
+			os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func parseInts(s string) (rv []int, err error) {
+	if s == "" {
+		return nil, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, v)
+	}
+	return rv, nil
+}
+
+func openInput(path string, stdin io.Reader) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(stdin), nil
+	}
+	return os.Open(path)
+}
+
+// parseFlags parses args into flags, returning errUsage unless there are
+// exactly nargs positional arguments left.
+func parseFlags(flags *flag.FlagSet, args []string, nargs int) error {
+	err := flags.Parse(args)
+	if err != nil {
+		return errUsage
+	}
+	if flags.NArg() != nargs {
+		flags.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+func build(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	format := flags.String("format", "csv",
+		"input format: csv, tsv, npy or binary (serialized points)")
+	dims := flags.Int("dims", 0,
+		"number of dimensions (defaults to the number of -columns)")
+	maxData := flags.Int("max-data", 0, "maximum length of point data")
+	header := flags.Bool("header", false, "csv/tsv: skip the first row")
+	columns := flags.String("columns", "",
+		"csv/tsv: comma-separated coordinate columns, numbered from 1")
+	dataColumn := flags.Int("data-column", 0,
+		"csv/tsv: column to use as point data, numbered from 1")
+	ids := flags.String("ids", "", "npy: .npy file of ids to use as point data")
+	tmpdir := flags.String("tmpdir", os.TempDir(),
+		"directory for temporary files")
+	workers := flags.Int("workers", 1, "number of subtrees to build at once")
+	bucket := flags.Int("bucket", 0, "points per leaf bucket")
+	normalize := flags.Bool("normalize", false,
+		"scale points to unit length for cosine search")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"usage: dkdtree build -dims N [flags] <input> <tree>\n"+
+				"<input> may be - for stdin.\n")
+		flags.PrintDefaults()
+	}
+	err := parseFlags(flags, args, 2)
+	if err != nil {
+		return err
+	}
+
+	cols, err := parseInts(*columns)
+	if err != nil {
+		return fmt.Errorf("invalid -columns: %v", err)
+	}
+	if *dims == 0 {
+		*dims = len(cols)
+	}
+	if *dims <= 0 {
+		return fmt.Errorf("-dims is required")
+	}
+
+	in, err := openInput(flags.Arg(0), stdin)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	opts := &dkdtree.BuildOptions{
+		Workers:    *workers,
+		BucketSize: *bucket,
+		Normalize:  *normalize,
+	}
+
+	var tree *dkdtree.Tree
+	if *format == "binary" {
+		tree, err = dkdtree.CreateTreeFromReader(context.Background(),
+			flags.Arg(1), *tmpdir, *dims, *maxData, in, opts)
+		if err != nil {
+			return err
+		}
+		return tree.Close()
+	}
+
+	pointsDir, err := ioutil.TempDir(*tmpdir, "dkdtree-points-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(pointsDir)
+	points, err := dkdtree.NewPointSet(filepath.Join(pointsDir, "points"),
+		*dims, *maxData)
+	if err != nil {
+		return err
+	}
+	defer points.Close()
+
+	switch *format {
+	case "csv", "tsv":
+		csvOpts := &dkdtree.CSVOptions{
+			Header:     *header,
+			Columns:    cols,
+			DataColumn: *dataColumn,
+		}
+		if *format == "tsv" {
+			csvOpts.Comma = '\t'
+		}
+		_, err = dkdtree.ImportCSV(points, in, csvOpts)
+	case "npy":
+		var idsReader io.Reader
+		if *ids != "" {
+			fh, err := os.Open(*ids)
+			if err != nil {
+				return err
+			}
+			defer fh.Close()
+			idsReader = fh
+		}
+		_, err = dkdtree.ImportNPY(points, in, idsReader)
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		return err
+	}
+
+	tree, err = dkdtree.CreateTreeWithOptions(flags.Arg(1), *tmpdir, points,
+		opts)
+	if err != nil {
+		return err
+	}
+	return tree.Close()
+}
+
+type jsonPoint struct {
+	Pos      []float64 `json:"pos"`
+	Data     []byte    `json:"data,omitempty"`
+	Distance *float64  `json:"distance,omitempty"`
+}
+
+type jsonResult struct {
+	Query   []float64   `json:"query"`
+	Results []jsonPoint `json:"results"`
+}
+
+func parseMetric(name string) (dkdtree.Metric, error) {
+	switch name {
+	case "euclidean":
+		return dkdtree.Euclidean{}, nil
+	case "manhattan":
+		return dkdtree.Manhattan{}, nil
+	case "chebyshev":
+		return dkdtree.Chebyshev{}, nil
+	}
+	return nil, fmt.Errorf("unknown metric %q", name)
+}
+
+func query(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	k := flags.Int("k", 10, "number of nearest neighbors to find")
+	radius := flags.Float64("radius", -1,
+		"if not negative, find every point within this distance instead")
+	metric := flags.String("metric", "euclidean",
+		"distance metric: euclidean, manhattan or chebyshev")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: dkdtree query [flags] <tree>\n"+
+			"Reads one query vector per line from stdin, with coordinates\n"+
+			"separated by commas or whitespace, and writes a JSON object\n"+
+			"per query to stdout, with point data base64-encoded. Euclidean\n"+
+			"distances are squared. Queries against a tree built with\n"+
+			"-normalize are scaled to unit length first, like the tree's\n"+
+			"points were.\n")
+		flags.PrintDefaults()
+	}
+	err := parseFlags(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	m, err := parseMetric(*metric)
+	if err != nil {
+		return err
+	}
+	opts := &dkdtree.SearchOptions{Metric: m}
+
+	tree, err := dkdtree.OpenTree(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+
+	out := bufio.NewWriter(stdout)
+	defer out.Flush()
+	enc := json.NewEncoder(out)
+
+	scanner := bufio.NewScanner(stdin)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.FieldsFunc(scanner.Text(), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) == 0 {
+			continue
+		}
+		q := dkdtree.Point{Pos: make([]float64, 0, len(fields))}
+		for _, field := range fields {
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return fmt.Errorf("line %d: %q is not a number", line, field)
+			}
+			q.Pos = append(q.Pos, v)
+		}
+		if tree.Normalized() {
+			q.Pos, err = dkdtree.Normalize(q.Pos)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+
+		var results []dkdtree.PointDistance
+		if *radius >= 0 {
+			maxDistance := *radius
+			if *metric == "euclidean" {
+				maxDistance *= maxDistance
+			}
+			results, err = tree.WithinWithOptions(q, maxDistance, opts)
+		} else {
+			results, err = tree.NearestWithOptions(q, *k, opts)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+
+		rv := jsonResult{Query: q.Pos, Results: make([]jsonPoint, 0,
+			len(results))}
+		for _, result := range results {
+			distance := result.Distance
+			rv.Results = append(rv.Results, jsonPoint{
+				Pos:      result.Pos,
+				Data:     result.Data,
+				Distance: &distance})
+		}
+		err = enc.Encode(rv)
+		if err != nil {
+			return err
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+func info(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("info", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: dkdtree info <tree>\n")
+	}
+	err := parseFlags(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	tree, err := dkdtree.OpenTree(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+
+	fmt.Fprintf(stdout, "dims:       %d\n", tree.Dims())
+	fmt.Fprintf(stdout, "count:      %d\n", tree.Count())
+	fmt.Fprintf(stdout, "deleted:    %d\n", tree.Deleted())
+	fmt.Fprintf(stdout, "depth:      %d\n", tree.Depth())
+	fmt.Fprintf(stdout, "maxDataLen: %d\n", tree.MaxDataLen())
+	fmt.Fprintf(stdout, "normalized: %v\n", tree.Normalized())
+	fmt.Fprintf(stdout, "created:    %v\n", tree.Created())
+	return nil
+}
+
+func dump(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	npy := flags.String("npy", "",
+		"write positions to this .npy file instead of JSON to stdout")
+	ids := flags.String("ids", "", "with -npy, write point data to this .npy file")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: dkdtree dump [flags] <tree>\n"+
+			"Writes every point as a JSON object per line, with its data\n"+
+			"base64-encoded.\n")
+		flags.PrintDefaults()
+	}
+	err := parseFlags(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	tree, err := dkdtree.OpenTree(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+
+	if *npy != "" {
+		return dumpNPY(tree, *npy, *ids)
+	}
+
+	out := bufio.NewWriter(stdout)
+	defer out.Flush()
+	enc := json.NewEncoder(out)
+
+	min := make([]float64, tree.Dims())
+	max := make([]float64, tree.Dims())
+	for i := range min {
+		min[i], max[i] = math.Inf(-1), math.Inf(1)
+	}
+	err = tree.RangeFunc(min, max, func(p dkdtree.Point) error {
+		return enc.Encode(jsonPoint{Pos: p.Pos, Data: p.Data})
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+func dumpNPY(tree *dkdtree.Tree, npyPath, idsPath string) error {
+	points, err := os.Create(npyPath)
+	if err != nil {
+		return err
+	}
+	defer points.Close()
+	if idsPath == "" {
+		err = dkdtree.ExportNPY(tree, points, nil)
+	} else {
+		var ids *os.File
+		ids, err = os.Create(idsPath)
+		if err != nil {
+			return err
+		}
+		defer ids.Close()
+		err = dkdtree.ExportNPY(tree, points, ids)
+		if err == nil {
+			err = ids.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return points.Close()
+}
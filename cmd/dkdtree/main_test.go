@@ -0,0 +1,186 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jtolds/dkdtree"
+)
+
+func run(t *testing.T, cmd func([]string, io.Reader, io.Writer) error,
+	stdin string, args ...string) string {
+	var stdout bytes.Buffer
+	err := cmd(args, strings.NewReader(stdin), &stdout)
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return stdout.String()
+}
+
+func decodeResults(t *testing.T, out string) (rv []jsonResult) {
+	dec := json.NewDecoder(strings.NewReader(out))
+	for dec.More() {
+		var result jsonResult
+		err := dec.Decode(&result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rv = append(rv, result)
+	}
+	return rv
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkdtree-cmd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "points.csv")
+	err = ioutil.WriteFile(input, []byte("id,x,y\na,0,0\nb,1,1\nc,5,5\nd,2,2\n"),
+		0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := filepath.Join(dir, "points.tree")
+	run(t, build, "", "-header", "-columns", "2,3", "-data-column", "1",
+		"-max-data", "4", "-tmpdir", dir, input, tree)
+
+	out := run(t, info, "", tree)
+	for _, line := range []string{"dims:       2", "count:      4",
+		"maxDataLen: 4"} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("info output %q is missing %q", out, line)
+		}
+	}
+
+	results := decodeResults(t, run(t, query, "0.9 0.9\n5,5\n", "-k", "2",
+		tree))
+	if len(results) != 2 {
+		t.Fatalf("got %d query results, expected 2", len(results))
+	}
+	for i, expected := range [][]string{{"b", "a"}, {"c", "d"}} {
+		if len(results[i].Results) != 2 {
+			t.Fatalf("query %d got %d results, expected 2", i,
+				len(results[i].Results))
+		}
+		for j, data := range expected {
+			if string(results[i].Results[j].Data) != data {
+				t.Fatalf("query %d result %d is %q, expected %q", i, j,
+					results[i].Results[j].Data, data)
+			}
+		}
+	}
+
+	// a zero radius finds only exact matches
+	results = decodeResults(t, run(t, query, "1 1\n", "-radius", "0", tree))
+	if len(results) != 1 || len(results[0].Results) != 1 ||
+		string(results[0].Results[0].Data) != "b" {
+		t.Fatalf("unexpected radius results: %+v", results)
+	}
+
+	var dumped []jsonPoint
+	dec := json.NewDecoder(strings.NewReader(run(t, dump, "", tree)))
+	for dec.More() {
+		var p jsonPoint
+		err = dec.Decode(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dumped = append(dumped, p)
+	}
+	if len(dumped) != 4 {
+		t.Fatalf("dumped %d points, expected 4", len(dumped))
+	}
+
+	err = query([]string{"-k", "1"}, strings.NewReader(""), ioutil.Discard)
+	if err != errUsage {
+		t.Fatalf("got %v, expected usage error", err)
+	}
+}
+
+func TestQueryNormalized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkdtree-cmd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tree := filepath.Join(dir, "points.tree")
+	run(t, build, "3,0\n0,2\n1,1\n", "-dims", "2", "-normalize", "-tmpdir",
+		dir, "-", tree)
+
+	results := decodeResults(t, run(t, query, "10 0\n", "-k", "1", tree))
+	if len(results) != 1 || len(results[0].Results) != 1 {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	result := results[0].Results[0]
+	if math.Abs(result.Pos[0]-1) > 1e-9 || math.Abs(*result.Distance) > 1e-9 {
+		t.Fatalf("got %v at distance %v, expected [1 0] at distance 0",
+			result.Pos, *result.Distance)
+	}
+}
+
+func TestBinaryData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkdtree-cmd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte{0xff, 0, 0xfe}
+	points, err := dkdtree.NewPointSet(filepath.Join(dir, "points"), 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer points.Close()
+	err = points.Add(dkdtree.Point{Pos: []float64{1, 2}, Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "points.tree")
+	tree, err := dkdtree.CreateTree(path, dir, points)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tree.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := decodeResults(t, run(t, query, "1 2\n", "-k", "1", path))
+	if len(results) != 1 || len(results[0].Results) != 1 ||
+		!bytes.Equal(results[0].Results[0].Data, data) {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	var dumped jsonPoint
+	err = json.Unmarshal([]byte(run(t, dump, "", path)), &dumped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dumped.Data, data) {
+		t.Fatalf("dumped data %v, expected %v", dumped.Data, data)
+	}
+}
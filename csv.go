@@ -0,0 +1,136 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"encoding/csv"
+	"io"
+	"math"
+	"strconv"
+)
+
+// CSVOptions control how ImportCSV reads delimited text. Columns are numbered
+// from 1, as with cut(1), so that zero can mean unset.
+type CSVOptions struct {
+	// Comma is the field delimiter. Zero means ','. Use '\t' for TSV.
+	Comma rune
+
+	// Header skips the first row.
+	Header bool
+
+	// Columns lists the columns holding each coordinate, in order. It must
+	// have one entry per dimension of the PointSet. nil means the first
+	// columns in the row, skipping DataColumn.
+	Columns []int
+
+	// DataColumn, if set, is the column whose text becomes Point.Data.
+	DataColumn int
+}
+
+func (opts *CSVOptions) columns(dims int) ([]int, error) {
+	if opts.Columns == nil {
+		columns := make([]int, 0, dims)
+		for col := 1; len(columns) < dims; col++ {
+			if col != opts.DataColumn {
+				columns = append(columns, col)
+			}
+		}
+		return columns, nil
+	}
+	if len(opts.Columns) != dims {
+		return nil, errClass.New("%d coordinate columns given, expected %d",
+			len(opts.Columns), dims)
+	}
+	for _, col := range opts.Columns {
+		if col < 1 {
+			return nil, errClass.New("invalid column %d", col)
+		}
+	}
+	return opts.Columns, nil
+}
+
+// ImportCSV adds a point to pl for every row of delimited text in r,
+// returning how many were added. Every row must have the same number of
+// columns, and every coordinate must be a finite number. Errors give the
+// line and column of the offending value; rows before it will have been
+// added.
+func ImportCSV(pl *PointSet, r io.Reader, opts *CSVOptions) (int64, error) {
+	if opts == nil {
+		opts = &CSVOptions{}
+	}
+	columns, err := opts.columns(pl.dims)
+	if err != nil {
+		return 0, err
+	}
+	if opts.DataColumn < 0 {
+		return 0, errClass.New("invalid data column %d", opts.DataColumn)
+	}
+
+	cr := csv.NewReader(r)
+	if opts.Comma != 0 {
+		cr.Comma = opts.Comma
+	}
+	cr.ReuseRecord = true
+
+	var count int64
+	for row := 0; ; row++ {
+		record, err := cr.Read()
+		if err != nil {
+			if err == io.EOF {
+				return count, nil
+			}
+			return count, errClass.Wrap(err)
+		}
+		if row == 0 && opts.Header {
+			continue
+		}
+		line, _ := cr.FieldPos(0)
+
+		p := Point{Pos: make([]float64, len(columns))}
+		for i, col := range columns {
+			if col > len(record) {
+				return count, errClass.New("line %d: has %d columns, expected "+
+					"at least %d", line, len(record), col)
+			}
+			p.Pos[i], err = strconv.ParseFloat(record[col-1], 64)
+			if err != nil {
+				return count, errClass.New("line %d, column %d: %q is not a "+
+					"number", line, col, record[col-1])
+			}
+			if math.IsNaN(p.Pos[i]) || math.IsInf(p.Pos[i], 0) {
+				return count, errClass.New("line %d, column %d: %q is not a "+
+					"finite number", line, col, record[col-1])
+			}
+		}
+		if opts.DataColumn > 0 {
+			if opts.DataColumn > len(record) {
+				return count, errClass.New("line %d: has %d columns, expected "+
+					"at least %d", line, len(record), opts.DataColumn)
+			}
+			p.Data = []byte(record[opts.DataColumn-1])
+			if len(p.Data) > pl.maxDataLen {
+				return count, errClass.New("line %d, column %d: data length "+
+					"(%d) greater than max data length (%d)", line,
+					opts.DataColumn, len(p.Data), pl.maxDataLen)
+			}
+		}
+
+		err = pl.Add(p)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+}
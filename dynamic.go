@@ -0,0 +1,527 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spacemonkeygo/errors"
+)
+
+const (
+	defaultBufferSize = 4096
+
+	// manifestName is the file in a DynamicTree's directory that lists its
+	// levels.
+	manifestName = "MANIFEST"
+
+	// lockName is the file in a DynamicTree's directory that is locked while
+	// the tree is open.
+	lockName = "LOCK"
+
+	// tmpDirName is the subdirectory of a DynamicTree's directory that holds
+	// the temporary files of merges.
+	tmpDirName = "tmp"
+
+	levelPrefix = "level-"
+	levelSuffix = ".tree"
+)
+
+// DynamicOptions control how a DynamicTree stores its points.
+type DynamicOptions struct {
+	// BufferSize is how many added points are held in memory before they are
+	// built into a tree. Zero means 4096.
+	BufferSize int
+
+	// Build configures how each of the underlying trees is built.
+	Build *BuildOptions
+
+	// Open configures how each of the underlying trees is opened.
+	Open *OpenOptions
+}
+
+// DynamicTree is a kd-tree that points can be added to after it is built. It
+// uses the logarithmic method: points are kept in a set of static Trees
+// where level i holds at most BufferSize*2^i points. Added points are
+// buffered in memory until BufferSize of them have been added, and are then
+// built into a new tree along with the points of levels 0 through k-1, where
+// k is the first empty level, replacing them as level k. Each point is
+// rebuilt at most once per level, and a query searches every level.
+//
+// The levels are stored as files in a directory, along with a manifest
+// naming the file for each level. A merge only takes effect once the new
+// manifest replaces the old one, so a crash never leaves a point in two
+// levels. Buffered points are only written to disk by Flush or Close.
+type DynamicTree struct {
+	dir              string
+	dims, maxDataLen int
+	opts             DynamicOptions
+	lock             *os.File
+
+	mtx    sync.RWMutex
+	buffer []Point
+	levels []*Tree
+}
+
+// OpenDynamicTree opens the DynamicTree stored in dir, creating dir if it
+// doesn't exist. dims and maxDataLen must match any existing levels. A nil
+// opts uses the defaults. dir is locked until the tree is closed, so only
+// one DynamicTree may have it open at a time. A non-empty dir must already
+// hold a DynamicTree. Level files left behind by an interrupted merge are
+// removed, but other files in dir are left alone.
+func OpenDynamicTree(dir string, dims, maxDataLen int,
+	opts *DynamicOptions) (*DynamicTree, error) {
+	if opts == nil {
+		opts = &DynamicOptions{}
+	}
+	d := &DynamicTree{
+		dir:        dir,
+		dims:       dims,
+		maxDataLen: maxDataLen,
+		opts:       *opts,
+	}
+	if d.opts.BufferSize <= 0 {
+		d.opts.BufferSize = defaultBufferSize
+	}
+
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	err = d.checkDir()
+	if err != nil {
+		return nil, err
+	}
+	d.lock, err = lockFile(filepath.Join(dir, lockName))
+	if err != nil {
+		return nil, err
+	}
+	names, err := d.readManifest()
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	for level, name := range names {
+		if name == "" {
+			d.levels = append(d.levels, nil)
+			continue
+		}
+		path := filepath.Join(dir, name)
+		t, err := OpenTreeWithOptions(path, d.opts.Open)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		d.levels = append(d.levels, t)
+		if t.Dims() != dims || t.MaxDataLen() != maxDataLen {
+			d.Close()
+			return nil, errClass.New("level %d has dims %d and max data len "+
+				"%d, expected %d and %d", level, t.Dims(), t.MaxDataLen(), dims,
+				maxDataLen)
+		}
+	}
+
+	err = d.removeStrays()
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// checkDir returns an error if the directory has no manifest but holds files
+// that a DynamicTree doesn't create, in which case it isn't ours to use.
+func (d *DynamicTree) checkDir() error {
+	_, err := os.Stat(filepath.Join(d.dir, manifestName))
+	if !os.IsNotExist(err) {
+		return errClass.Wrap(err)
+	}
+	entries, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != lockName && entry.Name() != tmpDirName &&
+			!isLevelFile(entry.Name()) {
+			return errClass.New("%#v is not empty and has no manifest", d.dir)
+		}
+	}
+	return nil
+}
+
+// readManifest returns the file name of each level listed in the manifest,
+// or "" for empty levels. If there is no manifest yet, an empty one is
+// written.
+func (d *DynamicTree) readManifest() (names []string, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(d.dir, manifestName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, errClass.Wrap(err)
+		}
+		err = os.MkdirAll(d.tmpDir(), 0777)
+		if err != nil {
+			return nil, errClass.Wrap(err)
+		}
+		return nil, d.writeManifest(nil)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		var level int
+		var name string
+		_, err := fmt.Sscanf(line, "%d %s", &level, &name)
+		if err != nil || level < 0 || !isLevelName(name) {
+			return nil, errClass.New("invalid manifest line %q", line)
+		}
+		for len(names) <= level {
+			names = append(names, "")
+		}
+		names[level] = name
+	}
+	return names, nil
+}
+
+// isLevelName returns whether name is the name of a level file.
+func isLevelName(name string) bool {
+	return strings.HasPrefix(name, levelPrefix) &&
+		strings.HasSuffix(name, levelSuffix) && name == filepath.Base(name)
+}
+
+// isLevelFile returns whether name is a level file or the tombstones of one.
+func isLevelFile(name string) bool {
+	return isLevelName(name) || isLevelName(strings.TrimSuffix(name,
+		filepath.Base(tombstonePath(""))))
+}
+
+// levelPath returns a new path to build a level at.
+func (d *DynamicTree) levelPath() string {
+	return filepath.Join(d.dir,
+		levelPrefix+filepath.Base(tempName(d.dir))+levelSuffix)
+}
+
+// tmpDir returns the directory merges keep their temporary files in.
+func (d *DynamicTree) tmpDir() string {
+	return filepath.Join(d.dir, tmpDirName)
+}
+
+// writeManifest atomically replaces the manifest with one listing levels.
+func (d *DynamicTree) writeManifest(levels []*Tree) error {
+	tmp := tempName(d.tmpDir())
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	defer os.Remove(tmp)
+
+	buf := bufio.NewWriter(fh)
+	for level, t := range levels {
+		if t != nil {
+			fmt.Fprintf(buf, "%d %s\n", level, filepath.Base(t.path))
+		}
+	}
+	var errs errors.ErrorGroup
+	errs.Add(buf.Flush())
+	errs.Add(fh.Sync())
+	errs.Add(fh.Close())
+	err = errs.Finalize()
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	return errClass.Wrap(os.Rename(tmp, filepath.Join(d.dir, manifestName)))
+}
+
+// removeStrays removes the level files that aren't part of a live level,
+// such as those of levels replaced by a merge that crashed before removing
+// them, along with the temporary files of merges that never finished. Since
+// the directory is locked, no other merge can be using them.
+func (d *DynamicTree) removeStrays() error {
+	keep := map[string]bool{}
+	for _, t := range d.levels {
+		if t != nil {
+			keep[filepath.Base(t.path)] = true
+			keep[filepath.Base(tombstonePath(t.path))] = true
+		}
+	}
+	entries, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	var errs errors.ErrorGroup
+	for _, entry := range entries {
+		if isLevelFile(entry.Name()) && !keep[entry.Name()] {
+			errs.Add(os.Remove(filepath.Join(d.dir, entry.Name())))
+		}
+	}
+	errs.Add(os.RemoveAll(d.tmpDir()))
+	errs.Add(os.MkdirAll(d.tmpDir(), 0777))
+	return errClass.Wrap(errs.Finalize())
+}
+
+// Close flushes any buffered points, closes every level and unlocks the
+// directory.
+func (d *DynamicTree) Close() error {
+	var errs errors.ErrorGroup
+	errs.Add(d.Flush())
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for i, t := range d.levels {
+		if t != nil {
+			errs.Add(t.Close())
+			d.levels[i] = nil
+		}
+	}
+	if d.lock != nil {
+		errs.Add(d.lock.Close())
+		d.lock = nil
+	}
+	return errs.Finalize()
+}
+
+// Count returns the number of points in the tree, including buffered ones.
+func (d *DynamicTree) Count() (count int64) {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	for _, t := range d.levels {
+		if t != nil {
+			count += t.Count()
+		}
+	}
+	return count + int64(len(d.buffer))
+}
+
+// Add adds p to the tree. It is visible to queries immediately. Every
+// BufferSize points, Add merges the buffered points into the levels, which
+// blocks queries until the merge is done.
+func (d *DynamicTree) Add(p Point) error {
+	if len(p.Pos) != d.dims {
+		return errClass.New("point has wrong dimension: %d, expected %d",
+			len(p.Pos), d.dims)
+	}
+	if len(p.Data) > d.maxDataLen {
+		return errClass.New("data length (%d) greater than max data length (%d)",
+			len(p.Data), d.maxDataLen)
+	}
+	// the buffer outlives this call, so it can't share the caller's slices.
+	p = p.clone()
+	if d.opts.Build != nil && d.opts.Build.Normalize {
+		var err error
+		p.Pos, err = Normalize(p.Pos)
+		if err != nil {
+			return err
+		}
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.buffer = append(d.buffer, p)
+	if len(d.buffer) < d.opts.BufferSize {
+		return nil
+	}
+	return d.merge(context.Background())
+}
+
+// Flush merges any buffered points into the levels so that they are stored
+// on disk.
+func (d *DynamicTree) Flush() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.merge(context.Background())
+}
+
+// merge builds the buffered points and the points of every level below the
+// first empty one into a new tree, which takes the place of that empty level.
+// The mutex must be held.
+func (d *DynamicTree) merge(ctx context.Context) (err error) {
+	if len(d.buffer) == 0 {
+		return nil
+	}
+	k := 0
+	for k < len(d.levels) && d.levels[k] != nil {
+		k++
+	}
+
+	points, err := newPointSet(tempName(d.tmpDir()), d.dims, d.maxDataLen,
+		samplingSize, true)
+	if err != nil {
+		return err
+	}
+	defer points.Close()
+	for _, p := range d.buffer {
+		err = points.Add(p)
+		if err != nil {
+			return err
+		}
+	}
+	for _, t := range d.levels[:k] {
+		err = t.scan(ctx, points.Add)
+		if err != nil {
+			return err
+		}
+	}
+
+	path := d.levelPath()
+	t, err := CreateTreeContext(ctx, path, d.tmpDir(), points, d.opts.Build)
+	if err != nil {
+		return err
+	}
+	err = t.Close()
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	t, err = OpenTreeWithOptions(path, d.opts.Open)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	levels := append([]*Tree(nil), d.levels...)
+	for i := range levels[:k] {
+		levels[i] = nil
+	}
+	if k == len(levels) {
+		levels = append(levels, nil)
+	}
+	levels[k] = t
+	err = d.writeManifest(levels)
+	if err != nil {
+		t.Close()
+		os.Remove(path)
+		return err
+	}
+
+	var errs errors.ErrorGroup
+	for _, old := range d.levels[:k] {
+		errs.Add(old.Close())
+		errs.Add(os.Remove(old.path))
+		err := os.Remove(tombstonePath(old.path))
+		if !os.IsNotExist(err) {
+			errs.Add(err)
+		}
+	}
+	d.levels = levels
+	d.buffer = nil
+	return errs.Finalize()
+}
+
+// Nearest is like Tree.Nearest, searching every level and the buffered
+// points.
+func (d *DynamicTree) Nearest(p Point, n int) ([]PointDistance, error) {
+	return d.NearestWithOptions(p, n, nil)
+}
+
+// NearestWithOptions is like Tree.NearestWithOptions, searching every level
+// and the buffered points.
+func (d *DynamicTree) NearestWithOptions(p Point, n int,
+	opts *SearchOptions) ([]PointDistance, error) {
+	return d.NearestContext(context.Background(), p, n, opts)
+}
+
+// NearestContext is like Tree.NearestContext, searching every level and the
+// buffered points.
+func (d *DynamicTree) NearestContext(ctx context.Context, p Point, n int,
+	opts *SearchOptions) ([]PointDistance, error) {
+	q, err := d.newQuery(ctx, p, opts)
+	if err != nil {
+		return nil, err
+	}
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+
+	h := make(maxHeap, 0, n)
+	for _, t := range d.levels {
+		if t == nil {
+			continue
+		}
+		rv, err := t.NearestContext(ctx, p, n, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, pd := range rv {
+			h.offer(pd.Point, pd.Distance)
+		}
+	}
+	for i := range d.buffer {
+		if dist, ok := q.distance(&d.buffer[i]); ok {
+			h.offer(d.buffer[i], dist)
+		}
+	}
+	sort.Sort(sort.Reverse(&h))
+	return h, nil
+}
+
+// Within is like Tree.Within, searching every level and the buffered points.
+func (d *DynamicTree) Within(p Point, radius float64) ([]PointDistance,
+	error) {
+	return d.WithinWithOptions(p, radius*radius, nil)
+}
+
+// WithinWithOptions is like Tree.WithinWithOptions, searching every level and
+// the buffered points.
+func (d *DynamicTree) WithinWithOptions(p Point, maxDistance float64,
+	opts *SearchOptions) ([]PointDistance, error) {
+	return d.WithinContext(context.Background(), p, maxDistance, opts)
+}
+
+// WithinContext is like Tree.WithinContext, searching every level and the
+// buffered points.
+func (d *DynamicTree) WithinContext(ctx context.Context, p Point,
+	maxDistance float64, opts *SearchOptions) ([]PointDistance, error) {
+	q, err := d.newQuery(ctx, p, opts)
+	if err != nil {
+		return nil, err
+	}
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+
+	var rv maxHeap
+	for _, t := range d.levels {
+		if t == nil {
+			continue
+		}
+		found, err := t.WithinContext(ctx, p, maxDistance, opts)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, found...)
+	}
+	for i := range d.buffer {
+		dist, ok := q.distance(&d.buffer[i])
+		if ok && dist <= maxDistance {
+			rv = append(rv, PointDistance{
+				Point:    d.buffer[i],
+				Distance: dist})
+		}
+	}
+	sort.Sort(sort.Reverse(&rv))
+	return rv, nil
+}
+
+func (d *DynamicTree) newQuery(ctx context.Context, p Point,
+	opts *SearchOptions) (*query, error) {
+	if len(p.Pos) != d.dims {
+		return nil, errClass.New("query has wrong dimension: %d, expected %d",
+			len(p.Pos), d.dims)
+	}
+	return newQuery(ctx, p, opts)
+}
@@ -0,0 +1,150 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	headerMagic   = "DKDTREE\x00"
+	headerVersion = 1
+
+	// headerSize is fixed so that nodes always start at the same place.
+	// Unused space is reserved for future fields and must be zero. Any change
+	// to the meaning of the layout below must bump headerVersion, so that
+	// older readers reject files they would misparse.
+	headerSize = 128
+)
+
+// header is the first headerSize bytes of a tree file. All integers are
+// little-endian, laid out as follows:
+//
+//	 0  magic (8 bytes)
+//	 8  version (uint32)
+//	12  dims (uint32)
+//	16  max data length (uint32)
+//	20  node length (uint32)
+//	24  node count (int64)
+//	32  root offset (int64)
+//	40  creation time, unix nanoseconds (int64)
+//	48  median sampling size (uint32)
+//	52  tree depth (uint32)
+//	56  split strategy (uint32)
+//	60  split dimension strategy (uint32)
+//	64  leaf bucket size, or 0 if unbucketed (uint32)
+//	72  point count (int64)
+//	80  1 if points were normalized to unit length, else 0 (uint32)
+type header struct {
+	Version    uint32
+	Dims       uint32
+	MaxDataLen uint32
+	NodeLen    uint32
+	Count      int64
+	Root       int64
+	Created    int64
+	SampleSize uint32
+	Depth      uint32
+	Split      uint32
+	SplitDim   uint32
+	BucketSize uint32
+	Points     int64
+	Normalized uint32
+}
+
+func (h *header) serialize(w io.Writer) error {
+	var buf [headerSize]byte
+	copy(buf[:], headerMagic)
+	binary.LittleEndian.PutUint32(buf[8:], h.Version)
+	binary.LittleEndian.PutUint32(buf[12:], h.Dims)
+	binary.LittleEndian.PutUint32(buf[16:], h.MaxDataLen)
+	binary.LittleEndian.PutUint32(buf[20:], h.NodeLen)
+	binary.LittleEndian.PutUint64(buf[24:], uint64(h.Count))
+	binary.LittleEndian.PutUint64(buf[32:], uint64(h.Root))
+	binary.LittleEndian.PutUint64(buf[40:], uint64(h.Created))
+	binary.LittleEndian.PutUint32(buf[48:], h.SampleSize)
+	binary.LittleEndian.PutUint32(buf[52:], h.Depth)
+	binary.LittleEndian.PutUint32(buf[56:], h.Split)
+	binary.LittleEndian.PutUint32(buf[60:], h.SplitDim)
+	binary.LittleEndian.PutUint32(buf[64:], h.BucketSize)
+	binary.LittleEndian.PutUint64(buf[72:], uint64(h.Points))
+	binary.LittleEndian.PutUint32(buf[80:], h.Normalized)
+	_, err := w.Write(buf[:])
+	return errClass.Wrap(err)
+}
+
+func parseHeader(buf []byte) (h header, err error) {
+	if len(buf) < headerSize ||
+		!bytes.Equal(buf[:len(headerMagic)], []byte(headerMagic)) {
+		return h, errClass.New("not a tree file")
+	}
+	h.Version = binary.LittleEndian.Uint32(buf[8:])
+	if h.Version != headerVersion {
+		return h, errClass.New("unsupported tree file version %d", h.Version)
+	}
+	h.Dims = binary.LittleEndian.Uint32(buf[12:])
+	h.MaxDataLen = binary.LittleEndian.Uint32(buf[16:])
+	h.NodeLen = binary.LittleEndian.Uint32(buf[20:])
+	h.Count = int64(binary.LittleEndian.Uint64(buf[24:]))
+	h.Root = int64(binary.LittleEndian.Uint64(buf[32:]))
+	h.Created = int64(binary.LittleEndian.Uint64(buf[40:]))
+	h.SampleSize = binary.LittleEndian.Uint32(buf[48:])
+	h.Depth = binary.LittleEndian.Uint32(buf[52:])
+	h.Split = binary.LittleEndian.Uint32(buf[56:])
+	h.SplitDim = binary.LittleEndian.Uint32(buf[60:])
+	h.BucketSize = binary.LittleEndian.Uint32(buf[64:])
+	h.Points = int64(binary.LittleEndian.Uint64(buf[72:]))
+	h.Normalized = binary.LittleEndian.Uint32(buf[80:])
+	return h, nil
+}
+
+// validate checks the header for internal consistency and against the length
+// of the file it came from.
+func (h *header) validate(filelen int64) error {
+	expected := nodeSize(int(h.Dims), int(h.MaxDataLen), h.BucketSize > 0)
+	if int(h.NodeLen) != expected {
+		return errClass.New("invalid tree file: node length %d, expected %d",
+			h.NodeLen, expected)
+	}
+	// nodes in bucketed trees may be longer than NodeLen.
+	minlen := headerSize + h.Count*int64(h.NodeLen)
+	if h.Count < 0 || h.Points < h.Count || filelen < minlen ||
+		h.BucketSize == 0 && filelen != minlen {
+		return errClass.New("invalid tree file: length %d for %d nodes",
+			filelen, h.Count)
+	}
+	// the root is always the first node, right after the header, which also
+	// guarantees it starts on a node boundary.
+	if h.Count == 0 && h.Root != -1 || h.Count > 0 && h.Root != headerSize {
+		return errClass.New("invalid tree file: bad root offset %d", h.Root)
+	}
+	return nil
+}
+
+func newHeader(dims, maxDataLen, bucketSize int) header {
+	return header{
+		Version:    headerVersion,
+		Dims:       uint32(dims),
+		MaxDataLen: uint32(maxDataLen),
+		NodeLen:    uint32(nodeSize(dims, maxDataLen, bucketSize > 0)),
+		BucketSize: uint32(bucketSize),
+		Root:       -1,
+		Created:    time.Now().UnixNano(),
+		SampleSize: samplingSize,
+	}
+}
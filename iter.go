@@ -0,0 +1,108 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"container/heap"
+	"context"
+	"math"
+)
+
+// NearestIterator yields the points of a Tree in order of increasing distance
+// from a query point, reading only as much of the tree as it needs to. It is
+// used like a bufio.Scanner:
+//
+//	it, err := tree.NearestIter(p, nil)
+//	if err != nil {
+//		return err
+//	}
+//	for it.Next() {
+//		result := it.PointDistance()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		return err
+//	}
+type NearestIterator struct {
+	t     *Tree
+	q     *query
+	queue nodeQueue
+	cur   PointDistance
+	err   error
+}
+
+// NearestIter returns an iterator over every point in the tree in order of
+// increasing distance from p. Epsilon and MaxVisits don't apply; the iterator
+// is always exact.
+func (t *Tree) NearestIter(p Point, opts *SearchOptions) (
+	*NearestIterator, error) {
+	q, err := t.newQuery(context.Background(), p, opts)
+	if err != nil {
+		return nil, err
+	}
+	it := &NearestIterator{t: t, q: q}
+	if t.root != -1 {
+		it.queue = nodeQueue{{offset: t.root}}
+	}
+	return it, nil
+}
+
+// Next advances to the next closest point, returning false once there are no
+// points left or an error occurs.
+func (it *NearestIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for it.queue.Len() > 0 {
+		nb := heap.Pop(&it.queue).(nodeBound)
+		if nb.point != nil {
+			it.cur = PointDistance{Point: *nb.point, Distance: nb.bound}
+			return true
+		}
+
+		n, err := it.t.Node(nb.offset)
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		it.t.each(nb.offset, &n, func(p Point, _ int64) error {
+			it.push(p)
+			return nil
+		})
+
+		near, far, farBound := it.q.split(&n)
+		if near != -1 {
+			heap.Push(&it.queue, nodeBound{offset: near, bound: nb.bound})
+		}
+		if far != -1 {
+			heap.Push(&it.queue, nodeBound{offset: far,
+				bound: math.Max(nb.bound, farBound)})
+		}
+	}
+	return false
+}
+
+func (it *NearestIterator) push(p Point) {
+	if dist, ok := it.q.distance(&p); ok {
+		heap.Push(&it.queue, nodeBound{offset: -1, bound: dist, point: &p})
+	}
+}
+
+// PointDistance returns the point found by the last call to Next.
+func (it *NearestIterator) PointDistance() PointDistance { return it.cur }
+
+// Err returns the error, if any, that stopped iteration.
+func (it *NearestIterator) Err() error { return it.err }
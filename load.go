@@ -0,0 +1,100 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bufio"
+	"context"
+	"io"
+)
+
+// CreateTreeFromFunc is like CreateTreeContext, but builds the tree from the
+// points returned by next until it returns io.EOF, rather than from a
+// PointSet. next may reuse the slices of a point once it is called again.
+// The points are staged in a temporary PointSet in tmpdir, which is removed
+// once the tree is built.
+func CreateTreeFromFunc(ctx context.Context, path, tmpdir string,
+	dims, maxDataLen int, next func() (Point, error),
+	opts *BuildOptions) (*Tree, error) {
+	fs, err := newBaseFS(tempName(tmpdir))
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Delete()
+
+	points, err := newPointSet(fs.Temp(), dims, maxDataLen, samplingSize, true)
+	if err != nil {
+		return nil, err
+	}
+	defer points.Close()
+
+	for i := 0; ; i++ {
+		if i%scanCheckInterval == 0 {
+			err = ctx.Err()
+			if err != nil {
+				return nil, err
+			}
+		}
+		p, err := next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		err = points.Add(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return CreateTreeContext(ctx, path, tmpdir, points, opts)
+}
+
+// CreateTreeFromReader is like CreateTreeFromFunc, but reads the points from
+// r, in the format a PointSet file is written in. The points may have been
+// serialized with any max data length, so long as their data fits in
+// maxDataLen.
+func CreateTreeFromReader(ctx context.Context, path, tmpdir string,
+	dims, maxDataLen int, r io.Reader, opts *BuildOptions) (*Tree, error) {
+	br := bufio.NewReader(r)
+	return CreateTreeFromFunc(ctx, path, tmpdir, dims, maxDataLen,
+		func() (Point, error) {
+			p, _, err := parsePointFromReader(br)
+			if err != nil && err != io.EOF {
+				return Point{}, errClass.Wrap(err)
+			}
+			return p, err
+		}, opts)
+}
+
+// CreateTreeFromChan is like CreateTreeFromFunc, but receives the points from
+// ch until it is closed.
+func CreateTreeFromChan(ctx context.Context, path, tmpdir string,
+	dims, maxDataLen int, ch <-chan Point, opts *BuildOptions) (*Tree,
+	error) {
+	return CreateTreeFromFunc(ctx, path, tmpdir, dims, maxDataLen,
+		func() (Point, error) {
+			select {
+			case p, ok := <-ch:
+				if !ok {
+					return Point{}, io.EOF
+				}
+				return p, nil
+			case <-ctx.Done():
+				return Point{}, ctx.Err()
+			}
+		}, opts)
+}
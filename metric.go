@@ -0,0 +1,177 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"math"
+)
+
+// Metric measures the distance between points. Distances only need to be
+// comparable with each other, so a Metric may skip a final monotonic step
+// like a square root; Euclidean, for instance, reports squared distances.
+type Metric interface {
+	// Distance returns the distance between positions a and b.
+	Distance(a, b []float64) float64
+
+	// PlaneDistance returns a lower bound on the distance between a position
+	// and any position on the other side of a plane perpendicular to
+	// dimension dim, where delta is the position's offset from the plane
+	// along dim.
+	PlaneDistance(delta float64, dim int) float64
+}
+
+// metricValidator is implemented by metrics that only work for some
+// parameters or numbers of dimensions.
+type metricValidator interface {
+	validate(dims int) error
+}
+
+func validateMetric(m Metric, dims int) error {
+	if v, ok := m.(metricValidator); ok {
+		return v.validate(dims)
+	}
+	return nil
+}
+
+// scaledMetric is implemented by metrics that report some function of the
+// true distance, such as its square.
+type scaledMetric interface {
+	// scale returns how much a reported distance grows when the true
+	// distance grows by factor.
+	scale(factor float64) float64
+}
+
+// scaleDistance returns how much a distance reported by m grows when the
+// true distance grows by factor. Metrics are assumed to report true
+// distances unless they say otherwise.
+func scaleDistance(m Metric, factor float64) float64 {
+	if s, ok := m.(scaledMetric); ok {
+		return s.scale(factor)
+	}
+	return factor
+}
+
+// Euclidean is the L2 metric. It reports squared distances.
+type Euclidean struct{}
+
+func (Euclidean) Distance(a, b []float64) (sum float64) {
+	for i, v := range a {
+		delta := v - b[i]
+		sum += delta * delta
+	}
+	return sum
+}
+
+func (Euclidean) PlaneDistance(delta float64, dim int) float64 {
+	return delta * delta
+}
+
+func (Euclidean) scale(factor float64) float64 { return factor * factor }
+
+// Manhattan is the L1 metric.
+type Manhattan struct{}
+
+func (Manhattan) Distance(a, b []float64) (sum float64) {
+	for i, v := range a {
+		sum += math.Abs(v - b[i])
+	}
+	return sum
+}
+
+func (Manhattan) PlaneDistance(delta float64, dim int) float64 {
+	return math.Abs(delta)
+}
+
+// Chebyshev is the L-infinity metric: the largest difference along any one
+// dimension.
+type Chebyshev struct{}
+
+func (Chebyshev) Distance(a, b []float64) (max float64) {
+	for i, v := range a {
+		max = math.Max(max, math.Abs(v-b[i]))
+	}
+	return max
+}
+
+func (Chebyshev) PlaneDistance(delta float64, dim int) float64 {
+	return math.Abs(delta)
+}
+
+// WeightedEuclidean is the L2 metric with each dimension scaled by a weight.
+// It reports squared distances.
+type WeightedEuclidean struct {
+	// Weights has one non-negative weight per dimension, which multiplies
+	// the squared difference along that dimension.
+	Weights []float64
+}
+
+func (m WeightedEuclidean) Distance(a, b []float64) (sum float64) {
+	for i, v := range a {
+		delta := v - b[i]
+		sum += m.Weights[i] * delta * delta
+	}
+	return sum
+}
+
+func (m WeightedEuclidean) PlaneDistance(delta float64, dim int) float64 {
+	return m.Weights[dim] * delta * delta
+}
+
+func (WeightedEuclidean) scale(factor float64) float64 {
+	return factor * factor
+}
+
+func (m WeightedEuclidean) validate(dims int) error {
+	if len(m.Weights) != dims {
+		return errClass.New("metric has %d weights, expected %d",
+			len(m.Weights), dims)
+	}
+	for i, w := range m.Weights {
+		if !(w >= 0) || math.IsInf(w, 1) {
+			return errClass.New("metric has invalid weight %v for dimension %d",
+				w, i)
+		}
+	}
+	return nil
+}
+
+// Minkowski is the general Lp metric. It reports distances raised to the
+// power P, so that Minkowski{P: 2} reports the same distances as Euclidean.
+type Minkowski struct {
+	// P must be positive.
+	P float64
+}
+
+func (m Minkowski) Distance(a, b []float64) (sum float64) {
+	for i, v := range a {
+		sum += math.Pow(math.Abs(v-b[i]), m.P)
+	}
+	return sum
+}
+
+func (m Minkowski) PlaneDistance(delta float64, dim int) float64 {
+	return math.Pow(math.Abs(delta), m.P)
+}
+
+func (m Minkowski) scale(factor float64) float64 {
+	return math.Pow(factor, m.P)
+}
+
+func (m Minkowski) validate(dims int) error {
+	if !(m.P > 0) || math.IsInf(m.P, 1) {
+		return errClass.New("metric has invalid P %v, must be positive", m.P)
+	}
+	return nil
+}
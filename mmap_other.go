@@ -12,34 +12,19 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
 package dkdtree
 
 import (
-	"io"
+	"os"
 )
 
-type writeMeter struct {
-	w      io.Writer
-	Amount int64
-}
-
-func newWriteMeter(w io.Writer) *writeMeter {
-	return &writeMeter{w: w}
-}
-
-func (w *writeMeter) Write(p []byte) (n int, err error) {
-	n, err = w.w.Write(p)
-	w.Amount += int64(n)
-	return n, err
-}
-
-type wrappedReader struct {
-	r   io.Reader
-	pos int64
+func mmapFile(fh *os.File, size int64) ([]byte, error) {
+	return nil, errClass.New("mmap is not supported on this platform")
 }
 
-func (w *wrappedReader) Read(p []byte) (n int, err error) {
-	n, err = w.r.Read(p)
-	w.pos += int64(n)
-	return n, err
+func munmapFile(data []byte) error {
+	return nil
 }
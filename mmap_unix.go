@@ -0,0 +1,39 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package dkdtree
+
+import (
+	"os"
+	"syscall"
+)
+
+func mmapFile(fh *os.File, size int64) ([]byte, error) {
+	if int64(int(size)) != size {
+		return nil, errClass.New("file too large to mmap: %d bytes", size)
+	}
+	data, err := syscall.Mmap(int(fh.Fd()), 0, int(size), syscall.PROT_READ,
+		syscall.MAP_SHARED)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	return data, nil
+}
+
+func munmapFile(data []byte) error {
+	return errClass.Wrap(syscall.Munmap(data))
+}
@@ -16,19 +16,32 @@ package dkdtree
 
 import (
 	"bufio"
+	"encoding/binary"
 	"os"
+	"sync/atomic"
 
 	"github.com/spacemonkeygo/errors"
 )
 
+// nodeLog is a log of nodes written in post-order, so children always come
+// before their parents. A build may write to several node logs at once, one
+// per worker. Every node is assigned space from a counter shared by all of
+// the logs in a build, and is identified by the offset of the end of that
+// space, which it is written prefixed by so the logs can be stitched together
+// by reverseTree. Nodes are identified by their end rather than their start
+// so that reverseTree can find where they start once reversed without knowing
+// their size.
 type nodeLog struct {
 	fh               *os.File
 	buf              *bufio.Writer
 	dims, maxDataLen int
-	offset           int64
+	bucketed         bool
+	path             string
+	next             *int64
 }
 
-func newNodeLog(path string, dims, maxDataLen int) (*nodeLog, error) {
+func newNodeLog(path string, dims, maxDataLen int, bucketed bool,
+	next *int64) (*nodeLog, error) {
 	fh, err := os.Create(path)
 	if err != nil {
 		return nil, errClass.Wrap(err)
@@ -38,6 +51,9 @@ func newNodeLog(path string, dims, maxDataLen int) (*nodeLog, error) {
 		buf:        bufio.NewWriter(fh),
 		dims:       dims,
 		maxDataLen: maxDataLen,
+		bucketed:   bucketed,
+		path:       path,
+		next:       next,
 	}, nil
 }
 
@@ -48,51 +64,17 @@ func (nl *nodeLog) Close() error {
 	return errs.Finalize()
 }
 
-func (nl *nodeLog) Add(n Node) (offset int64, err error) {
-	offset = nl.offset
-
+func (nl *nodeLog) Add(n Node) (end int64, err error) {
 	if len(n.Point.Pos) != nl.dims {
-		return offset, errClass.New("point has wrong dimension: %d, expected %d",
+		return -1, errClass.New("point has wrong dimension: %d, expected %d",
 			len(n.Point.Pos), nl.dims)
 	}
 
-	meter := newWriteMeter(nl.buf)
-	err = n.serialize(meter, nl.maxDataLen)
-	nl.offset += meter.Amount
-	return offset, err
-}
-
-func (nl *nodeLog) Build(fs *baseFS, log *PointSet, dim int) (
-	node_offset int64, err error) {
-	defer log.Close()
-	if log.count == 0 {
-		return -1, nil
-	}
+	end = atomic.AddInt64(nl.next, n.size(nl.maxDataLen, nl.bucketed))
 
-	median := log.medianEstimate(dim)
-	left, right, err := log.split(fs, median, dim, true)
+	err = binary.Write(nl.buf, binary.LittleEndian, end)
 	if err != nil {
-		return -1, err
+		return -1, errClass.Wrap(err)
 	}
-
-	defer left.Close()
-	defer right.Close()
-
-	ndim := (dim + 1) % log.dims
-
-	leftOffset, err := nl.Build(fs, left, ndim)
-	if err != nil {
-		return -1, err
-	}
-
-	rightOffset, err := nl.Build(fs, right, ndim)
-	if err != nil {
-		return -1, err
-	}
-
-	return nl.Add(Node{
-		Point: median,
-		Dim:   uint32(dim),
-		Left:  leftOffset,
-		Right: rightOffset})
+	return end, n.serialize(nl.buf, nl.maxDataLen, nl.bucketed)
 }
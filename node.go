@@ -19,13 +19,38 @@ import (
 	"io"
 )
 
+// nodeSize is the size of a serialized node, not counting any bucket points.
+// Nodes in bucketed trees have an extra field for the bucket size.
+func nodeSize(dims, maxDataLen int, bucketed bool) int {
+	size := pointSize(dims, maxDataLen) + 2*uint64Size + uint32Size
+	if bucketed {
+		size += uint32Size
+	}
+	return size
+}
+
 type Node struct {
 	Dim         uint32
 	Left, Right int64
 	Point       Point
+
+	// Bucket holds any further points stored along with Point in a leaf
+	// bucket. It is always empty unless the tree was built with a
+	// BucketSize.
+	Bucket []Point
 }
 
-func (n *Node) serialize(w io.Writer, maxDataLen int) error {
+func (n *Node) size(maxDataLen int, bucketed bool) int64 {
+	dims := len(n.Point.Pos)
+	return int64(nodeSize(dims, maxDataLen, bucketed) +
+		len(n.Bucket)*pointSize(dims, maxDataLen))
+}
+
+func (n *Node) serialize(w io.Writer, maxDataLen int, bucketed bool) error {
+	if len(n.Bucket) > 0 && !bucketed {
+		return errClass.New("bucket in unbucketed tree")
+	}
+
 	err := n.Point.serialize(w, maxDataLen)
 	if err != nil {
 		return err
@@ -40,10 +65,31 @@ func (n *Node) serialize(w io.Writer, maxDataLen int) error {
 		return errClass.Wrap(err)
 	}
 
-	return errClass.Wrap(binary.Write(w, binary.LittleEndian, n.Dim))
+	err = binary.Write(w, binary.LittleEndian, n.Dim)
+	if err != nil || !bucketed {
+		return errClass.Wrap(err)
+	}
+
+	err = binary.Write(w, binary.LittleEndian, uint32(len(n.Bucket)))
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	for _, p := range n.Bucket {
+		err = p.serialize(w, maxDataLen)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func parseNode(data []byte) (rv Node, err error) {
+// parseBucketLen returns the number of bucket points in the serialized node
+// at the start of data, which must be at least nodeSize bytes long.
+func parseBucketLen(data []byte, nodelen int) int {
+	return int(binary.LittleEndian.Uint32(data[nodelen-uint32Size:]))
+}
+
+func parseNode(data []byte, bucketed bool) (rv Node, err error) {
 	var remaining []byte
 	rv.Point, remaining, err = parsePoint(data)
 	if err != nil {
@@ -55,10 +101,26 @@ func parseNode(data []byte) (rv Node, err error) {
 	remaining = remaining[uint64Size:]
 	rv.Dim = binary.LittleEndian.Uint32(remaining)
 	remaining = remaining[uint32Size:]
+	if !bucketed {
+		return rv, nil
+	}
+
+	bucketLen := binary.LittleEndian.Uint32(remaining)
+	remaining = remaining[uint32Size:]
+	if bucketLen > 0 {
+		rv.Bucket = make([]Point, bucketLen)
+	}
+	for i := range rv.Bucket {
+		rv.Bucket[i], remaining, err = parsePoint(remaining)
+		if err != nil {
+			return rv, err
+		}
+	}
 	return rv, nil
 }
 
-func parseNodeFromReader(r io.Reader) (rv Node, maxDataLen int, err error) {
+func parseNodeFromReader(r io.Reader, bucketed bool) (rv Node,
+	maxDataLen int, err error) {
 	rv.Point, maxDataLen, err = parsePointFromReader(r)
 	if err != nil {
 		return rv, 0, err
@@ -74,6 +136,28 @@ func parseNodeFromReader(r io.Reader) (rv Node, maxDataLen int, err error) {
 		return rv, 0, errClass.Wrap(err)
 	}
 
-	return rv, maxDataLen, errClass.Wrap(
-		binary.Read(r, binary.LittleEndian, &rv.Dim))
+	err = binary.Read(r, binary.LittleEndian, &rv.Dim)
+	if err != nil || !bucketed {
+		return rv, maxDataLen, errClass.Wrap(err)
+	}
+
+	var bucketLen uint32
+	err = binary.Read(r, binary.LittleEndian, &bucketLen)
+	if err != nil {
+		return rv, 0, errClass.Wrap(err)
+	}
+	if bucketLen > 0 {
+		rv.Bucket = make([]Point, bucketLen)
+	}
+	for i := range rv.Bucket {
+		var pointMaxDataLen int
+		rv.Bucket[i], pointMaxDataLen, err = parsePointFromReader(r)
+		if err != nil {
+			return rv, 0, errClass.Wrap(err)
+		}
+		if pointMaxDataLen != maxDataLen {
+			return rv, 0, errClass.New("disparate max data len")
+		}
+	}
+	return rv, maxDataLen, nil
 }
@@ -0,0 +1,408 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// npyMagic starts every .npy file. It is followed by a major and minor
+// version byte and the length of the header, which is a Python dict literal
+// describing the array.
+const npyMagic = "\x93NUMPY"
+
+var (
+	npyDescr   = regexp.MustCompile(`['"]descr['"]\s*:\s*['"]([^'"]*)['"]`)
+	npyFortran = regexp.MustCompile(`['"]fortran_order['"]\s*:\s*(True|False)`)
+	npyShape   = regexp.MustCompile(`['"]shape['"]\s*:\s*\(([^)]*)\)`)
+)
+
+// npyType is a NumPy dtype, such as '<f8' for little-endian float64.
+type npyType struct {
+	order binary.ByteOrder
+	kind  byte
+	size  int
+}
+
+func parseNPYType(descr string) (rv npyType, err error) {
+	if len(descr) < 3 {
+		return rv, errClass.New("unsupported dtype %q", descr)
+	}
+	switch descr[0] {
+	case '<', '|', '=':
+		rv.order = binary.LittleEndian
+	case '>':
+		rv.order = binary.BigEndian
+	default:
+		return rv, errClass.New("unsupported dtype %q", descr)
+	}
+	rv.kind = descr[1]
+	rv.size, err = strconv.Atoi(descr[2:])
+	if err != nil || rv.size <= 0 {
+		return rv, errClass.New("unsupported dtype %q", descr)
+	}
+	return rv, nil
+}
+
+// itemSize returns the number of bytes each element takes up.
+func (typ npyType) itemSize() int {
+	if typ.kind == 'U' {
+		// unicode strings are stored as UTF-32
+		return 4 * typ.size
+	}
+	return typ.size
+}
+
+// float decodes a floating point element.
+func (typ npyType) float(data []byte) float64 {
+	if typ.size == 4 {
+		return float64(math.Float32frombits(typ.order.Uint32(data)))
+	}
+	return math.Float64frombits(typ.order.Uint64(data))
+}
+
+// text decodes an integer or string element into the bytes used for
+// Point.Data. Integers are written out in decimal, and strings have their
+// trailing NULs removed, as NumPy does.
+func (typ npyType) text(data []byte) []byte {
+	switch typ.kind {
+	case 'i':
+		return strconv.AppendInt(nil, typ.int(data), 10)
+	case 'u':
+		return strconv.AppendUint(nil, uint64(typ.int(data)), 10)
+	case 'S':
+		return append([]byte(nil), bytes.TrimRight(data, "\x00")...)
+	}
+	var rv []byte
+	for ; len(data) > 0; data = data[4:] {
+		r := rune(typ.order.Uint32(data))
+		if r == 0 {
+			break
+		}
+		rv = append(rv, string(r)...)
+	}
+	return rv
+}
+
+func (typ npyType) int(data []byte) int64 {
+	switch typ.size {
+	case 1:
+		if typ.kind == 'i' {
+			return int64(int8(data[0]))
+		}
+		return int64(data[0])
+	case 2:
+		if typ.kind == 'i' {
+			return int64(int16(typ.order.Uint16(data)))
+		}
+		return int64(typ.order.Uint16(data))
+	case 4:
+		if typ.kind == 'i' {
+			return int64(int32(typ.order.Uint32(data)))
+		}
+		return int64(typ.order.Uint32(data))
+	}
+	return int64(typ.order.Uint64(data))
+}
+
+// npyArray reads the elements of a .npy array in order.
+type npyArray struct {
+	r     *bufio.Reader
+	typ   npyType
+	shape []int64
+	buf   []byte
+}
+
+func readNPY(r io.Reader) (*npyArray, error) {
+	br := bufio.NewReader(r)
+	var prefix [len(npyMagic) + 2]byte
+	_, err := io.ReadFull(br, prefix[:])
+	if err != nil || string(prefix[:len(npyMagic)]) != npyMagic {
+		return nil, errClass.New("not a .npy file")
+	}
+	var headerLen int
+	switch prefix[len(npyMagic)] {
+	case 1:
+		var l uint16
+		err = binary.Read(br, binary.LittleEndian, &l)
+		headerLen = int(l)
+	case 2, 3:
+		var l uint32
+		err = binary.Read(br, binary.LittleEndian, &l)
+		headerLen = int(l)
+	default:
+		return nil, errClass.New("unsupported .npy version %d",
+			prefix[len(npyMagic)])
+	}
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	header := make([]byte, headerLen)
+	_, err = io.ReadFull(br, header)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+
+	descr := npyDescr.FindSubmatch(header)
+	fortran := npyFortran.FindSubmatch(header)
+	shape := npyShape.FindSubmatch(header)
+	if descr == nil || fortran == nil || shape == nil {
+		return nil, errClass.New("invalid .npy header: %q", header)
+	}
+	if string(fortran[1]) == "True" {
+		return nil, errClass.New("Fortran-ordered arrays are not supported")
+	}
+
+	a := &npyArray{r: br}
+	a.typ, err = parseNPYType(string(descr[1]))
+	if err != nil {
+		return nil, err
+	}
+	for _, dim := range strings.Split(string(shape[1]), ",") {
+		dim = strings.TrimSpace(dim)
+		if dim == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(dim, 10, 64)
+		if err != nil || n < 0 {
+			return nil, errClass.New("invalid .npy shape: %q", shape[1])
+		}
+		a.shape = append(a.shape, n)
+	}
+	a.buf = make([]byte, a.typ.itemSize())
+	return a, nil
+}
+
+// next reads the next element.
+func (a *npyArray) next() ([]byte, error) {
+	_, err := io.ReadFull(a.r, a.buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return a.buf, errClass.Wrap(err)
+}
+
+// ImportNPY adds a point to pl for every row of the 2-D floating point array
+// in the .npy file read from points, returning how many were added. The
+// array must have a column per dimension of pl. If ids is not nil, it is
+// read as a parallel 1-D array of integers or strings which become each
+// point's Data, with integers written in decimal. Both files are streamed,
+// so they can be larger than memory. Rows before an error will have been
+// added.
+func ImportNPY(pl *PointSet, points, ids io.Reader) (int64, error) {
+	pa, err := readNPY(points)
+	if err != nil {
+		return 0, err
+	}
+	if len(pa.shape) != 2 || pa.shape[1] != int64(pl.dims) {
+		return 0, errClass.New("array has shape %v, expected (n, %d)",
+			pa.shape, pl.dims)
+	}
+	if pa.typ.kind != 'f' || (pa.typ.size != 4 && pa.typ.size != 8) {
+		return 0, errClass.New("array has unsupported type %c%d, expected "+
+			"float32 or float64", pa.typ.kind, pa.typ.size)
+	}
+	rows := pa.shape[0]
+
+	var ia *npyArray
+	if ids != nil {
+		ia, err = readNPY(ids)
+		if err != nil {
+			return 0, err
+		}
+		if len(ia.shape) != 1 || ia.shape[0] != rows {
+			return 0, errClass.New("ids have shape %v, expected (%d,)",
+				ia.shape, rows)
+		}
+		switch {
+		case ia.typ.kind == 'S' || ia.typ.kind == 'U':
+		case (ia.typ.kind == 'i' || ia.typ.kind == 'u') &&
+			(ia.typ.size == 1 || ia.typ.size == 2 || ia.typ.size == 4 ||
+				ia.typ.size == 8):
+		default:
+			return 0, errClass.New("ids have unsupported type %c%d, expected "+
+				"integers or strings", ia.typ.kind, ia.typ.size)
+		}
+	}
+
+	var count int64
+	for ; count < rows; count++ {
+		p := Point{Pos: make([]float64, pl.dims)}
+		for i := range p.Pos {
+			data, err := pa.next()
+			if err != nil {
+				return count, err
+			}
+			p.Pos[i] = pa.typ.float(data)
+			if math.IsNaN(p.Pos[i]) || math.IsInf(p.Pos[i], 0) {
+				return count, errClass.New("row %d, column %d: %v is not a "+
+					"finite number", count, i, p.Pos[i])
+			}
+		}
+		if ia != nil {
+			data, err := ia.next()
+			if err != nil {
+				return count, err
+			}
+			p.Data = ia.typ.text(data)
+			if len(p.Data) > pl.maxDataLen {
+				return count, errClass.New("row %d: id length (%d) greater "+
+					"than max data length (%d)", count, len(p.Data),
+					pl.maxDataLen)
+			}
+		}
+		err = pl.Add(p)
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// ImportNPZ is like ImportNPY, but reads the arrays named points and ids
+// from the .npz archive in r, which is size bytes long. An empty ids means
+// no ids.
+func ImportNPZ(pl *PointSet, r io.ReaderAt, size int64,
+	points, ids string) (int64, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return 0, errClass.Wrap(err)
+	}
+	open := func(name string) (io.ReadCloser, error) {
+		for _, f := range zr.File {
+			if f.Name == name || f.Name == name+".npy" {
+				rc, err := f.Open()
+				return rc, errClass.Wrap(err)
+			}
+		}
+		return nil, errClass.New("no array named %q", name)
+	}
+
+	pr, err := open(points)
+	if err != nil {
+		return 0, err
+	}
+	defer pr.Close()
+	if ids == "" {
+		return ImportNPY(pl, pr, nil)
+	}
+	ir, err := open(ids)
+	if err != nil {
+		return 0, err
+	}
+	defer ir.Close()
+	return ImportNPY(pl, pr, ir)
+}
+
+// writeNPYHeader writes a version 1.0 .npy header, padded so the data that
+// follows it is aligned to 64 bytes.
+func writeNPYHeader(w io.Writer, descr string, shape ...int64) error {
+	dims := make([]string, 0, len(shape))
+	for _, n := range shape {
+		dims = append(dims, strconv.FormatInt(n, 10))
+	}
+	shapeStr := strings.Join(dims, ", ")
+	if len(shape) == 1 {
+		shapeStr += ","
+	}
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, "+
+		"'shape': (%s), }", descr, shapeStr)
+	prefixLen := len(npyMagic) + 2 + 2
+	pad := 64 - (prefixLen+len(header)+1)%64
+	if pad == 64 {
+		pad = 0
+	}
+	header += strings.Repeat(" ", pad) + "\n"
+
+	buf := make([]byte, 0, prefixLen+len(header))
+	buf = append(buf, npyMagic...)
+	buf = append(buf, 1, 0)
+	buf = append(buf, byte(len(header)), byte(len(header)>>8))
+	buf = append(buf, header...)
+	_, err := w.Write(buf)
+	return errClass.Wrap(err)
+}
+
+// ExportNPY writes the positions of every point in t that hasn't been
+// deleted to points as a 2-D float64 .npy array, one row per point. If ids is
+// not nil, the points' Data is written to it as a parallel array of byte
+// strings, which lose any trailing NULs.
+func ExportNPY(t *Tree, points, ids io.Writer) error {
+	rows := t.Count() - t.Deleted()
+	pw := bufio.NewWriter(points)
+	err := writeNPYHeader(pw, "<f8", rows, int64(t.dims))
+	if err != nil {
+		return err
+	}
+	var iw *bufio.Writer
+	idLen := t.maxDataLen
+	if idLen == 0 {
+		// NumPy has no zero length strings
+		idLen = 1
+	}
+	if ids != nil {
+		iw = bufio.NewWriter(ids)
+		err = writeNPYHeader(iw, fmt.Sprintf("|S%d", idLen), rows)
+		if err != nil {
+			return err
+		}
+	}
+
+	var written int64
+	var buf [uint64Size]byte
+	id := make([]byte, idLen)
+	err = t.scan(context.Background(), func(p Point) error {
+		written++
+		for _, v := range p.Pos {
+			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+			_, err := pw.Write(buf[:])
+			if err != nil {
+				return errClass.Wrap(err)
+			}
+		}
+		if iw == nil {
+			return nil
+		}
+		n := copy(id, p.Data)
+		for i := n; i < len(id); i++ {
+			id[i] = 0
+		}
+		_, err := iw.Write(id)
+		return errClass.Wrap(err)
+	})
+	if err != nil {
+		return err
+	}
+	if written != rows {
+		return errClass.New("wrote %d points, expected %d", written, rows)
+	}
+	if iw != nil {
+		err = iw.Flush()
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+	}
+	return errClass.Wrap(pw.Flush())
+}
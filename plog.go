@@ -16,7 +16,9 @@ package dkdtree
 
 import (
 	"bufio"
+	"context"
 	"io"
+	"math"
 	"math/rand"
 	"os"
 	"sort"
@@ -26,21 +28,34 @@ import (
 
 const (
 	samplingSize = 100
+
+	// selectionMemory is how many values exactMedian will hold in memory to
+	// finish a selection.
+	selectionMemory = 1 << 16
+
+	// scanCheckInterval is how many points scan reads between checks for
+	// cancellation.
+	scanCheckInterval = 1 << 12
 )
 
+// errStop is used to stop a scan early.
+var errStop = errClass.New("stop")
+
 type PointSet struct {
 	fh               *os.File
 	buf              *bufio.Writer
 	dims, maxDataLen int
 	count            int64
 	reservoir        []Point
+	sampleSize       int
+	spread           spread
 	deleteOnClose    bool
 	deleted          bool
 	path             string
 }
 
-func newPointSet(path string, dims, maxDataLen int, deleteOnClose bool) (
-	*PointSet, error) {
+func newPointSet(path string, dims, maxDataLen, sampleSize int,
+	deleteOnClose bool) (*PointSet, error) {
 	fh, err := os.Create(path)
 	if err != nil {
 		return nil, errClass.Wrap(err)
@@ -50,14 +65,75 @@ func newPointSet(path string, dims, maxDataLen int, deleteOnClose bool) (
 		buf:           bufio.NewWriter(fh),
 		dims:          dims,
 		maxDataLen:    maxDataLen,
-		reservoir:     make([]Point, 0, samplingSize),
+		reservoir:     make([]Point, 0, sampleSize),
+		sampleSize:    sampleSize,
 		deleteOnClose: deleteOnClose,
 		path:          path,
 	}, nil
 }
 
 func NewPointSet(path string, dims, maxDataLen int) (*PointSet, error) {
-	return newPointSet(path, dims, maxDataLen, false)
+	return newPointSet(path, dims, maxDataLen, samplingSize, false)
+}
+
+// OpenPointSet opens the point set at path for further points to be added,
+// creating it if it doesn't exist. Unlike NewPointSet, points already in the
+// file are kept, and must have been added with the same dims and maxDataLen.
+// A partially written point at the end of the file, as left by a crash, is
+// removed.
+func OpenPointSet(path string, dims, maxDataLen int) (*PointSet, error) {
+	pl := &PointSet{
+		dims:       dims,
+		maxDataLen: maxDataLen,
+		reservoir:  make([]Point, 0, samplingSize),
+		sampleSize: samplingSize,
+		path:       path,
+	}
+	err := pl.reload()
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, errClass.Wrap(err)
+	}
+	pl.fh = fh
+	pl.buf = bufio.NewWriter(fh)
+	return pl, nil
+}
+
+// reload reads the points already in pl's file, as if they were being added.
+func (pl *PointSet) reload() error {
+	fh, err := os.Open(pl.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errClass.Wrap(err)
+	}
+	defer fh.Close()
+
+	r := bufio.NewReader(fh)
+	var valid int64
+	for {
+		p, maxDataLen, err := parsePointFromReader(r)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return errClass.Wrap(os.Truncate(pl.path, valid))
+			}
+			return errClass.Wrap(err)
+		}
+		if len(p.Pos) != pl.dims || maxDataLen != pl.maxDataLen {
+			return errClass.New("%s has points with dimension %d and max data "+
+				"length %d, expected %d and %d", pl.path, len(p.Pos), maxDataLen,
+				pl.dims, pl.maxDataLen)
+		}
+		pl.record(p)
+		valid += int64(pointSize(pl.dims, pl.maxDataLen))
+	}
 }
 
 func (pl *PointSet) closeNoDel() error {
@@ -100,82 +176,203 @@ func (pl *PointSet) Add(p Point) error {
 	if err != nil {
 		return err
 	}
+	pl.record(p)
+	return nil
+}
+
+// Count returns the number of points in the set.
+func (pl *PointSet) Count() int64 { return pl.count }
+
+// record accounts for p having been added to pl.
+func (pl *PointSet) record(p Point) {
 	pl.count += 1
+	pl.spread.add(p.Pos)
+	// the sample outlives the call to Add, and callers such as
+	// CreateTreeFromFunc's producers may reuse p's slices once it returns.
 	if len(pl.reservoir) < cap(pl.reservoir) {
-		pl.reservoir = append(pl.reservoir, p)
+		pl.reservoir = append(pl.reservoir, p.clone())
 	} else {
 		pos := rand.Int63n(pl.count)
 		if pos < int64(len(pl.reservoir)) {
-			pl.reservoir[pos] = p
+			pl.reservoir[pos] = p.clone()
 		}
 	}
-	return nil
 }
 
-func (pl *PointSet) split(fs *baseFS, median Point, dim int,
-	deleteOnClose bool) (left, right *PointSet, err error) {
-	defer pl.Close()
-	err = pl.closeNoDel()
+// scan closes pl for writing and then calls fn with every point in it, in the
+// order they were added. It stops early with ctx.Err() if ctx is done.
+func (pl *PointSet) scan(ctx context.Context, fn func(p Point) error) error {
+	err := pl.closeNoDel()
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
 	fh, err := os.Open(pl.path)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 	defer fh.Close()
 
 	fhbuf := bufio.NewReader(fh)
 
-	left, err = newPointSet(fs.Temp(), pl.dims, pl.maxDataLen, deleteOnClose)
+	for i := int64(0); i < pl.count; i++ {
+		if i%scanCheckInterval == 0 {
+			err = ctx.Err()
+			if err != nil {
+				return err
+			}
+		}
+		data := make([]byte, pointSize(pl.dims, pl.maxDataLen))
+		_, err = io.ReadFull(fhbuf, data)
+		if err != nil {
+			return err
+		}
+		p, _, err := parsePoint(data)
+		if err != nil {
+			return err
+		}
+		err = fn(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PointIterator reads the points of a PointSet in the order they were added.
+// It is used like NearestIterator, but must be closed.
+type PointIterator struct {
+	fh        *os.File
+	r         *bufio.Reader
+	remaining int64
+	cur       Point
+	err       error
+}
+
+// Iter returns an iterator over the points added to pl so far. More points
+// can be added to pl while iterating, but the iterator won't include them.
+func (pl *PointSet) Iter() (*PointIterator, error) {
+	if pl.buf != nil {
+		err := pl.buf.Flush()
+		if err != nil {
+			return nil, errClass.Wrap(err)
+		}
+	}
+	fh, err := os.Open(pl.path)
 	if err != nil {
-		return nil, nil, err
+		return nil, errClass.Wrap(err)
 	}
+	return &PointIterator{
+		fh:        fh,
+		r:         bufio.NewReader(fh),
+		remaining: pl.count,
+	}, nil
+}
 
-	right, err = newPointSet(fs.Temp(), pl.dims, pl.maxDataLen, deleteOnClose)
+// Next advances to the next point, returning false once there are no points
+// left or an error occurs.
+func (it *PointIterator) Next() bool {
+	if it.err != nil || it.remaining <= 0 {
+		return false
+	}
+	p, _, err := parsePointFromReader(it.r)
+	if err != nil {
+		it.err = errClass.Wrap(err)
+		return false
+	}
+	it.cur = p
+	it.remaining--
+	return true
+}
+
+// Point returns the point read by the last call to Next.
+func (it *PointIterator) Point() Point { return it.cur }
+
+// Err returns the error, if any, that stopped iteration.
+func (it *PointIterator) Err() error { return it.err }
+
+// Close releases the iterator's file.
+func (it *PointIterator) Close() error {
+	return errClass.Wrap(it.fh.Close())
+}
+
+func (pl *PointSet) split(ctx context.Context, fs *baseFS, median Point,
+	dim int, deleteOnClose bool) (left, right *PointSet, err error) {
+	defer pl.Close()
+
+	left, err = newPointSet(fs.Temp(), pl.dims, pl.maxDataLen, pl.sampleSize,
+		deleteOnClose)
 	if err != nil {
-		left.closeNoDel()
-		left.del()
 		return nil, nil, err
 	}
 
-	closeUp := func() {
+	right, err = newPointSet(fs.Temp(), pl.dims, pl.maxDataLen, pl.sampleSize,
+		deleteOnClose)
+	if err != nil {
 		left.closeNoDel()
 		left.del()
-		right.closeNoDel()
-		right.del()
+		return nil, nil, err
 	}
 
 	foundMedian := false
-	for i := int64(0); i < pl.count; i++ {
-		data := make([]byte, pointSize(pl.dims, pl.maxDataLen))
-		_, err = io.ReadFull(fhbuf, data)
-		if err != nil {
-			closeUp()
-			return nil, nil, err
-		}
-		p, _, err := parsePoint(data)
-		if err != nil {
-			closeUp()
-			return nil, nil, err
-		}
+	err = pl.scan(ctx, func(p Point) error {
 		if !foundMedian && median.equal(&p) {
 			foundMedian = true
-			continue
+			return nil
 		}
 		if p.Pos[dim] <= median.Pos[dim] {
-			err = left.Add(p)
-		} else {
-			err = right.Add(p)
+			return left.Add(p)
 		}
+		return right.Add(p)
+	})
+	if err != nil {
+		left.closeNoDel()
+		left.del()
+		right.closeNoDel()
+		right.del()
+		return nil, nil, err
+	}
+
+	return left, right, nil
+}
+
+// normalized closes pl and returns a temporary copy of it with every point
+// scaled to unit length.
+func (pl *PointSet) normalized(ctx context.Context, fs *baseFS) (
+	rv *PointSet, err error) {
+	defer pl.Close()
+
+	rv, err = newPointSet(fs.Temp(), pl.dims, pl.maxDataLen, pl.sampleSize,
+		true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pl.scan(ctx, func(p Point) (err error) {
+		p.Pos, err = Normalize(p.Pos)
 		if err != nil {
-			closeUp()
-			return nil, nil, err
+			return err
 		}
+		return rv.Add(p)
+	})
+	if err != nil {
+		rv.Close()
+		return nil, err
 	}
+	return rv, nil
+}
 
-	return left, right, nil
+// load closes pl for writing and reads all of its points into memory.
+func (pl *PointSet) load(ctx context.Context) ([]Point, error) {
+	points := make([]Point, 0, pl.count)
+	err := pl.scan(ctx, func(p Point) error {
+		points = append(points, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
 }
 
 func (pl *PointSet) medianEstimate(dim int) Point {
@@ -189,6 +386,180 @@ func (pl *PointSet) medianEstimate(dim int) Point {
 	return ps.Points[len(ps.Points)/2]
 }
 
+// resample closes pl for writing and replaces its reservoir with a new random
+// sample of up to size points. Sets split from pl will use the same sample
+// size.
+func (pl *PointSet) resample(ctx context.Context, size int) error {
+	reservoir := make([]Point, 0, size)
+	var seen int64
+	err := pl.scan(ctx, func(p Point) error {
+		seen++
+		if len(reservoir) < cap(reservoir) {
+			reservoir = append(reservoir, p)
+		} else {
+			pos := rand.Int63n(seen)
+			if pos < int64(len(reservoir)) {
+				reservoir[pos] = p
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	pl.reservoir = reservoir
+	pl.sampleSize = size
+	return nil
+}
+
+// exactMedian finds a point with the median position along dim. It makes
+// repeated passes over pl, each narrowing the range of values the median can
+// be in, until that range is small enough to select from in memory.
+func (pl *PointSet) exactMedian(ctx context.Context, dim int) (Point, error) {
+	k := pl.count / 2
+	var lo, hi float64
+	hasLo, hasHi := false, false
+	inRange := func(v float64) bool {
+		return (!hasLo || v > lo) && (!hasHi || v < hi)
+	}
+
+	for {
+		var n int64
+		values := make([]float64, 0, selectionMemory)
+		sample := make([]float64, 0, pl.sampleSize)
+		err := pl.scan(ctx, func(p Point) error {
+			v := p.Pos[dim]
+			if !inRange(v) {
+				return nil
+			}
+			n++
+			if n <= selectionMemory {
+				values = append(values, v)
+			}
+			if len(sample) < cap(sample) {
+				sample = append(sample, v)
+			} else {
+				pos := rand.Int63n(n)
+				if pos < int64(len(sample)) {
+					sample[pos] = v
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return Point{}, err
+		}
+
+		if n <= selectionMemory {
+			sort.Float64s(values)
+			return pl.closestTo(ctx, dim, values[k])
+		}
+
+		sort.Float64s(sample)
+		pivot := sample[len(sample)/2]
+
+		var less, equal int64
+		err = pl.scan(ctx, func(p Point) error {
+			v := p.Pos[dim]
+			if inRange(v) {
+				if v < pivot {
+					less++
+				} else if v == pivot {
+					equal++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return Point{}, err
+		}
+
+		switch {
+		case k < less:
+			hi, hasHi = pivot, true
+		case k < less+equal:
+			return pl.closestTo(ctx, dim, pivot)
+		default:
+			k -= less + equal
+			lo, hasLo = pivot, true
+		}
+	}
+}
+
+// closestTo finds the first point whose position along dim is closest to
+// target.
+func (pl *PointSet) closestTo(ctx context.Context, dim int,
+	target float64) (rv Point, err error) {
+	best := math.Inf(1)
+	err = pl.scan(ctx, func(p Point) error {
+		delta := math.Abs(p.Pos[dim] - target)
+		if delta < best {
+			rv, best = p, delta
+			if delta == 0 {
+				return errStop
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errStop {
+		return Point{}, err
+	}
+	if math.IsInf(best, 1) {
+		return Point{}, errClass.New("no points in set")
+	}
+	return rv, nil
+}
+
+// spread tracks the range and variance of a set of points along each
+// dimension.
+type spread struct {
+	count              int64
+	min, max, mean, m2 []float64
+}
+
+func (s *spread) add(pos []float64) {
+	s.count++
+	if s.min == nil {
+		s.min = append([]float64(nil), pos...)
+		s.max = append([]float64(nil), pos...)
+		s.mean = make([]float64, len(pos))
+		s.m2 = make([]float64, len(pos))
+	}
+	for i, v := range pos {
+		if v < s.min[i] {
+			s.min[i] = v
+		}
+		if v > s.max[i] {
+			s.max[i] = v
+		}
+		// Welford's online variance
+		delta := v - s.mean[i]
+		s.mean[i] += delta / float64(s.count)
+		s.m2[i] += delta * (v - s.mean[i])
+	}
+}
+
+// widest returns the dimension with the largest spread according to
+// strategy, or dim if strategy is DimRoundRobin.
+func (s *spread) widest(strategy DimStrategy, dim int) int {
+	var widths []float64
+	switch strategy {
+	case DimMaxVariance:
+		widths = s.m2
+	case DimMaxRange:
+		widths = make([]float64, len(s.min))
+		for i := range widths {
+			widths[i] = s.max[i] - s.min[i]
+		}
+	}
+	for i, w := range widths {
+		if w > widths[dim] {
+			dim = i
+		}
+	}
+	return dim
+}
+
 type pointSorter struct {
 	Dim    int
 	Points []Point
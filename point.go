@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"math"
 )
 
 const (
@@ -65,6 +66,41 @@ func (p1 *Point) distanceSquared(p2 *Point) (sum float64) {
 	return sum
 }
 
+// Normalize returns a copy of pos scaled to unit length, as
+// BuildOptions.Normalize does to every point of a tree. It returns an error
+// if pos has zero length.
+func Normalize(pos []float64) ([]float64, error) {
+	var sum float64
+	for _, v := range pos {
+		sum += v * v
+	}
+	if sum == 0 {
+		return nil, errClass.New("can't normalize a zero-length point")
+	}
+	norm := math.Sqrt(sum)
+	rv := make([]float64, len(pos))
+	for i, v := range pos {
+		rv[i] = v / norm
+	}
+	return rv, nil
+}
+
+// clone returns a copy of p that doesn't share its slices.
+func (p *Point) clone() Point {
+	return Point{
+		Pos:  append([]float64(nil), p.Pos...),
+		Data: append([]byte(nil), p.Data...)}
+}
+
+func (p *Point) inBox(min, max []float64) bool {
+	for i, v := range p.Pos {
+		if v < min[i] || v > max[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (p *Point) serialize(w io.Writer, maxDataLen int) error {
 	if len(p.Data) > maxDataLen {
 		return errClass.New("data length (%d) greater than max data length (%d)",
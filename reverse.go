@@ -16,81 +16,94 @@ package dkdtree
 
 import (
 	"bufio"
+	"context"
+	"encoding/binary"
 	"io"
 	"os"
 )
 
-func reverseTree(oldpath, newpath string) error {
-	fh, err := os.Open(oldpath)
+// reverseTree stitches together the node logs at logpaths, in which children
+// precede their parents, into a tree file at newpath with h as its header and
+// the root as the first node. loglen is the total size of the nodes in the
+// logs.
+func reverseTree(ctx context.Context, logpaths []string, newpath string,
+	h header, loglen int64) error {
+	h.Root = -1
+	if h.Count > 0 {
+		h.Root = headerSize
+	}
+
+	dest, err := os.Create(newpath)
 	if err != nil {
 		return err
 	}
-	defer fh.Close()
+	defer dest.Close()
 
-	filelen, err := fh.Seek(0, 2)
+	err = h.serialize(dest)
 	if err != nil {
 		return err
 	}
-	if filelen == 0 {
-		dest, err := os.Create(newpath)
+
+	// a node ending at offset e in the logs starts at offset start-e in the
+	// tree file.
+	start := headerSize + loglen
+	for _, logpath := range logpaths {
+		err = reverseLog(ctx, logpath, dest, start, h)
 		if err != nil {
 			return err
 		}
-		dest.Close()
-		return nil
 	}
 
-	_, err = fh.Seek(0, 0)
-	if err != nil {
-		return err
-	}
+	return nil
+}
 
-	source := &wrappedReader{r: bufio.NewReader(fh)}
-	dest, err := os.Create(newpath)
+func reverseLog(ctx context.Context, logpath string, dest *os.File,
+	start int64, h header) error {
+	fh, err := os.Open(logpath)
 	if err != nil {
 		return err
 	}
-	defer dest.Close()
+	defer fh.Close()
 
-	nodelen := int64(-1)
-	maxDataLen := -1
-	for node_idx := int64(0); true; node_idx++ {
-		node, nodeMaxDataLen, err := parseNodeFromReader(source)
+	bucketed := h.BucketSize > 0
+	source := bufio.NewReader(fh)
+	for i := 0; ; i++ {
+		if i%scanCheckInterval == 0 {
+			err = ctx.Err()
+			if err != nil {
+				return err
+			}
+		}
+		var end int64
+		err = binary.Read(source, binary.LittleEndian, &end)
 		if err != nil {
 			if err == io.EOF {
-				break
+				return nil
 			}
 			return err
 		}
-		if maxDataLen == -1 {
-			maxDataLen = nodeMaxDataLen
-		}
-		if nodeMaxDataLen != maxDataLen {
-			return errClass.New("disparate max data len")
-		}
-		if nodelen == -1 {
-			nodelen = source.pos
-			if filelen%nodelen != 0 {
-				return errClass.New("Invalid tree file")
-			}
-		}
-		_, err = dest.Seek(filelen-nodelen*(1+node_idx), 0)
+		node, nodeMaxDataLen, err := parseNodeFromReader(source, bucketed)
 		if err != nil {
 			return err
 		}
+		if nodeMaxDataLen != int(h.MaxDataLen) {
+			return errClass.New("disparate max data len")
+		}
 
 		if node.Left != -1 {
-			node.Left = filelen - nodelen - node.Left
+			node.Left = start - node.Left
 		}
 		if node.Right != -1 {
-			node.Right = filelen - nodelen - node.Right
+			node.Right = start - node.Right
 		}
 
-		err = node.serialize(dest, maxDataLen)
+		_, err = dest.Seek(start-end, 0)
+		if err != nil {
+			return err
+		}
+		err = node.serialize(dest, int(h.MaxDataLen), bucketed)
 		if err != nil {
 			return err
 		}
 	}
-
-	return nil
 }
@@ -0,0 +1,268 @@
+// Copyright (C) 2016 JT Olds
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dkdtree
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Delete marks every point in the tree with the same position and data as p
+// as deleted, returning how many points were newly deleted. Deleted points
+// are skipped by every search, but still take up space in the tree file
+// until it is rebuilt with Compact. Deletions are recorded in a file next to
+// the tree file, named after it with a ".deleted" suffix. In a normalized
+// tree, p may be given either as it was added or as the tree returns it.
+func (t *Tree) Delete(p Point) (int, error) {
+	err := t.checkQuery(p)
+	if err != nil {
+		return 0, err
+	}
+	// normalizing a point the tree returned may not give back exactly the
+	// same point, so look for both forms.
+	n := p
+	if t.normalized {
+		n.Pos, err = Normalize(p.Pos)
+		if err != nil {
+			return 0, err
+		}
+	}
+	min := make([]float64, t.dims)
+	max := make([]float64, t.dims)
+	for i := range min {
+		min[i] = math.Min(p.Pos[i], n.Pos[i])
+		max[i] = math.Max(p.Pos[i], n.Pos[i])
+	}
+	var offsets []int64
+	err = t.searchRange(t.root, min, max,
+		func(np Point, offset int64) error {
+			if np.equal(&p) || np.equal(&n) {
+				offsets = append(offsets, offset)
+			}
+			return nil
+		})
+	if err != nil {
+		return 0, err
+	}
+	return t.tombstones.add(offsets)
+}
+
+// DeleteFunc is like Delete, but deletes every point for which fn returns
+// true. It reads the whole tree, so it is best used to delete many points at
+// once, such as every point whose Data is in a set of identifiers.
+func (t *Tree) DeleteFunc(fn func(p Point) bool) (int, error) {
+	var offsets []int64
+	err := t.scanNodes(context.Background(),
+		func(offset int64, n *Node) error {
+			return t.each(offset, n, func(p Point, offset int64) error {
+				if fn(p) {
+					offsets = append(offsets, offset)
+				}
+				return nil
+			})
+		})
+	if err != nil {
+		return 0, err
+	}
+	return t.tombstones.add(offsets)
+}
+
+// Deleted returns the number of points in the tree that have been deleted.
+// Count still includes them.
+func (t *Tree) Deleted() int64 { return t.tombstones.count() }
+
+// Compact writes a new tree to path holding every point of t that hasn't
+// been deleted, as CreateTreeWithOptions would with opts. A nil opts builds
+// it with the settings t was built with, such as BucketSize and Normalize.
+// Compacting is as expensive as building the tree was, so it is best done
+// once Deleted is a sizable fraction of Count, as CompactIfNeeded does. t is
+// left as it was.
+func (t *Tree) Compact(path, tmpdir string, opts *BuildOptions) (*Tree,
+	error) {
+	if filepath.Clean(path) == filepath.Clean(t.path) {
+		return nil, errClass.New("can't compact a tree into its own file")
+	}
+	if opts == nil {
+		settings := t.settings
+		opts = &settings
+	}
+	fs, err := newBaseFS(tempName(tmpdir))
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Delete()
+
+	points, err := newPointSet(fs.Temp(), t.dims, t.maxDataLen, samplingSize,
+		true)
+	if err != nil {
+		return nil, err
+	}
+	defer points.Close()
+	err = t.scan(context.Background(), points.Add)
+	if err != nil {
+		return nil, err
+	}
+	return CreateTreeWithOptions(path, tmpdir, points, opts)
+}
+
+// CompactIfNeeded is like Compact, but only compacts t if more than threshold
+// of its points have been deleted, as a fraction of Count. It returns a nil
+// Tree if t was left alone.
+func (t *Tree) CompactIfNeeded(threshold float64, path, tmpdir string,
+	opts *BuildOptions) (*Tree, error) {
+	if t.count == 0 || float64(t.Deleted())/float64(t.count) <= threshold {
+		return nil, nil
+	}
+	return t.Compact(path, tmpdir, opts)
+}
+
+// tombstoneMagic starts every tombstone file. It is followed by the creation
+// time and point count from the header of the tree the tombstones belong to,
+// so that tombstones left over from another tree at the same path are never
+// applied to the wrong points.
+const tombstoneMagic = "DKDDEAD\x00"
+
+const tombstoneHeaderSize = len(tombstoneMagic) + 2*uint64Size
+
+// tombstonePath is where the tombstones for the tree file at path are kept.
+func tombstonePath(path string) string { return path + ".deleted" }
+
+// tombstones is the set of deleted points in a tree, each identified by the
+// offset of the point in the tree file. It is stored alongside the tree file
+// as a header identifying the tree followed by a log of little-endian int64
+// offsets, which is appended to as points are deleted.
+type tombstones struct {
+	mtx     sync.RWMutex
+	path    string
+	header  []byte
+	fh      *os.File
+	current bool
+	offsets map[int64]bool
+}
+
+// openTombstones reads the tombstones at path for the tree with the given
+// creation time and point count. Tombstones for any other tree are ignored,
+// and replaced once a point is deleted.
+func openTombstones(path string, created, points int64) (*tombstones,
+	error) {
+	header := make([]byte, tombstoneHeaderSize)
+	copy(header, tombstoneMagic)
+	binary.LittleEndian.PutUint64(header[len(tombstoneMagic):],
+		uint64(created))
+	binary.LittleEndian.PutUint64(header[len(tombstoneMagic)+uint64Size:],
+		uint64(points))
+	ts := &tombstones{path: path, header: header, offsets: map[int64]bool{}}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ts, nil
+		}
+		return nil, errClass.Wrap(err)
+	}
+	if len(data) < len(header) || !bytes.Equal(data[:len(header)], header) {
+		return ts, nil
+	}
+	ts.current = true
+	// a partially written trailing offset is ignored.
+	data = data[len(header):]
+	for ; len(data) >= uint64Size; data = data[uint64Size:] {
+		ts.offsets[int64(binary.LittleEndian.Uint64(data))] = true
+	}
+	return ts, nil
+}
+
+func (ts *tombstones) Close() error {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	if ts.fh == nil {
+		return nil
+	}
+	err := ts.fh.Close()
+	ts.fh = nil
+	return errClass.Wrap(err)
+}
+
+func (ts *tombstones) contains(offset int64) bool {
+	ts.mtx.RLock()
+	defer ts.mtx.RUnlock()
+	return ts.offsets[offset]
+}
+
+func (ts *tombstones) count() int64 {
+	ts.mtx.RLock()
+	defer ts.mtx.RUnlock()
+	return int64(len(ts.offsets))
+}
+
+// add durably records offsets as deleted, returning how many weren't already.
+func (ts *tombstones) add(offsets []int64) (int, error) {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+
+	var added []int64
+	buf := make([]byte, 0, len(offsets)*uint64Size)
+	var tmp [uint64Size]byte
+	for _, offset := range offsets {
+		if ts.offsets[offset] {
+			continue
+		}
+		ts.offsets[offset] = true
+		added = append(added, offset)
+		binary.LittleEndian.PutUint64(tmp[:], uint64(offset))
+		buf = append(buf, tmp[:]...)
+	}
+	if len(added) == 0 {
+		return 0, nil
+	}
+
+	err := ts.write(buf)
+	if err != nil {
+		for _, offset := range added {
+			delete(ts.offsets, offset)
+		}
+		return 0, err
+	}
+	return len(added), nil
+}
+
+func (ts *tombstones) write(buf []byte) error {
+	if ts.fh == nil {
+		flags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+		if !ts.current {
+			flags |= os.O_TRUNC
+		}
+		fh, err := os.OpenFile(ts.path, flags, 0666)
+		if err != nil {
+			return errClass.Wrap(err)
+		}
+		ts.fh = fh
+		if !ts.current {
+			buf = append(append([]byte(nil), ts.header...), buf...)
+			ts.current = true
+		}
+	}
+	_, err := ts.fh.Write(buf)
+	if err != nil {
+		return errClass.Wrap(err)
+	}
+	return errClass.Wrap(ts.fh.Sync())
+}
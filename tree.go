@@ -18,10 +18,14 @@ package dkdtree
 
 import (
 	"bufio"
+	"bytes"
 	"container/heap"
+	"context"
 	"io"
+	"math"
 	"os"
 	"sort"
+	"time"
 
 	"github.com/spacemonkeygo/errors"
 )
@@ -31,46 +35,103 @@ var (
 )
 
 type Tree struct {
-	path    string
-	fh      *os.File
-	root    int64
-	count   int64
-	nodelen int64
+	path             string
+	fh               *os.File
+	root             int64
+	count            int64
+	nodelen          int64
+	filelen          int64
+	bucketed         bool
+	dims, maxDataLen int
+	created          time.Time
+	depth            int
+	normalized       bool
+	settings         BuildOptions // as recorded in the header
+	mapped           []byte
+	cache            *nodeCache
+	tombstones       *tombstones
+}
+
+// OpenOptions control how OpenTreeWithOptions accesses a tree file. Nodes
+// returned by a Tree with CacheSize or PinLevels set are shared with its
+// cache and must not be modified.
+type OpenOptions struct {
+	// Mmap memory-maps the tree file and parses nodes directly out of the
+	// mapping instead of reading them with a syscall each. Points returned
+	// by a memory-mapped Tree may alias the mapping: they must not be
+	// modified and are only valid until the Tree is closed.
+	Mmap bool
+
+	// CacheSize, if positive, caches recently used nodes in memory, up to
+	// about CacheSize bytes worth of serialized nodes.
+	CacheSize int64
+
+	// PinLevels keeps the top PinLevels levels of the tree in memory for as
+	// long as the tree is open, on top of anything cached due to CacheSize.
+	// Every query starts at the root, so these nodes are the most read.
+	PinLevels int
 }
 
 func CreateTree(path, tmpdir string, points *PointSet) (*Tree, error) {
-	fs, err := newBaseFS(tempName(tmpdir))
-	if err != nil {
-		return nil, err
-	}
-	defer fs.Delete()
+	return CreateTreeWithOptions(path, tmpdir, points, nil)
+}
+
+// CreateTreeWithOptions is like CreateTree but allows for configuring how the
+// tree is built. A nil opts is the same as CreateTree.
+func CreateTreeWithOptions(path, tmpdir string, points *PointSet,
+	opts *BuildOptions) (*Tree, error) {
+	return CreateTreeContext(context.Background(), path, tmpdir, points, opts)
+}
 
-	reversed := fs.Temp()
+// CreateTreeContext is like CreateTreeWithOptions but stops early if ctx is
+// done, returning ctx.Err(). Temporary files and any partially written tree
+// file are removed.
+func CreateTreeContext(ctx context.Context, path, tmpdir string,
+	points *PointSet, opts *BuildOptions) (*Tree, error) {
+	if opts == nil {
+		opts = &BuildOptions{}
+	}
 
-	nlog, err := newNodeLog(reversed, points.dims, points.maxDataLen)
+	fs, err := newBaseFS(tempName(tmpdir))
 	if err != nil {
 		return nil, err
 	}
+	defer fs.Delete()
 
-	_, err = nlog.Build(fs, points, 0)
-	if err != nil {
-		return nil, err
+	// deletions from any tree previously at path don't apply to this one.
+	err = os.Remove(tombstonePath(path))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errClass.Wrap(err)
 	}
 
-	err = nlog.Close()
+	b := newBuilder(ctx, fs, points.dims, points.maxDataLen, *opts)
+	logs, err := b.Build(points)
 	if err != nil {
 		return nil, err
 	}
 
-	err = reverseTree(reversed, path)
+	err = reverseTree(ctx, logs, path, b.header(), b.next)
 	if err != nil {
+		os.Remove(path)
 		return nil, err
 	}
 
 	return OpenTree(path)
 }
 
+// OpenTree opens a tree file previously written by CreateTree. Files that
+// don't start with a valid tree header are rejected.
 func OpenTree(path string) (*Tree, error) {
+	return OpenTreeWithOptions(path, nil)
+}
+
+// OpenTreeWithOptions is like OpenTree but allows for configuring how the
+// file is accessed. A nil opts is the same as OpenTree.
+func OpenTreeWithOptions(path string, opts *OpenOptions) (*Tree, error) {
+	if opts == nil {
+		opts = &OpenOptions{}
+	}
+
 	fh, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -81,60 +142,243 @@ func OpenTree(path string) (*Tree, error) {
 		fh.Close()
 		return nil, err
 	}
-	if filelen == 0 {
-		return &Tree{path: path, fh: fh, root: -1, count: 0}, nil
-	}
 
-	_, err = fh.Seek(0, 0)
+	buf := make([]byte, headerSize)
+	_, err = fh.ReadAt(buf, 0)
 	if err != nil {
 		fh.Close()
+		if err == io.EOF {
+			return nil, errClass.New("not a tree file")
+		}
 		return nil, err
 	}
 
-	_, _, err = parseNodeFromReader(fh)
+	h, err := parseHeader(buf)
 	if err != nil {
 		fh.Close()
 		return nil, err
 	}
 
-	nodelen, err := fh.Seek(0, 1)
+	err = h.validate(filelen)
 	if err != nil {
 		fh.Close()
 		return nil, err
 	}
 
-	if filelen%nodelen != 0 {
-		fh.Close()
-		return nil, errClass.New("Invalid tree file")
+	var mapped []byte
+	if opts.Mmap {
+		mapped, err = mmapFile(fh, filelen)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+	}
+
+	t := &Tree{
+		path:       path,
+		fh:         fh,
+		root:       h.Root,
+		count:      h.Points,
+		nodelen:    int64(h.NodeLen),
+		filelen:    filelen,
+		bucketed:   h.BucketSize > 0,
+		dims:       int(h.Dims),
+		maxDataLen: int(h.MaxDataLen),
+		created:    time.Unix(0, h.Created),
+		depth:      int(h.Depth),
+		normalized: h.Normalized != 0,
+		settings: BuildOptions{
+			Split:      SplitStrategy(h.Split),
+			SampleSize: int(h.SampleSize),
+			SplitDim:   DimStrategy(h.SplitDim),
+			BucketSize: int(h.BucketSize),
+			Normalize:  h.Normalized != 0},
+		mapped: mapped,
 	}
 
-	return &Tree{
-		path:    path,
-		fh:      fh,
-		root:    0,
-		count:   filelen / nodelen,
-		nodelen: nodelen,
-	}, nil
+	t.tombstones, err = openTombstones(tombstonePath(path), h.Created,
+		h.Points)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	if opts.CacheSize > 0 || opts.PinLevels > 0 {
+		t.cache = newNodeCache(opts.CacheSize)
+		err = t.cache.pin(t, opts.PinLevels)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	return t, nil
 }
 
 func (t *Tree) Close() error {
-	return t.fh.Close()
+	var errs errors.ErrorGroup
+	if t.mapped != nil {
+		errs.Add(munmapFile(t.mapped))
+		t.mapped = nil
+	}
+	if t.tombstones != nil {
+		errs.Add(t.tombstones.Close())
+	}
+	errs.Add(t.fh.Close())
+	return errs.Finalize()
 }
 
+// Count returns the number of points in the tree.
 func (t *Tree) Count() int64        { return t.count }
 func (t *Tree) Root() (Node, error) { return t.Node(t.root) }
 
+// Dims returns the dimensionality of the points in the tree.
+func (t *Tree) Dims() int { return t.dims }
+
+// MaxDataLen returns the maximum Point.Data length the tree was built with.
+func (t *Tree) MaxDataLen() int { return t.maxDataLen }
+
+// Created returns when the tree file was built.
+func (t *Tree) Created() time.Time { return t.created }
+
+// Depth returns the number of nodes on the longest path from the root to a
+// leaf.
+func (t *Tree) Depth() int { return t.depth }
+
+// Normalized returns whether the tree's points were normalized to unit length
+// when it was built.
+func (t *Tree) Normalized() bool { return t.normalized }
+
+// CacheStats returns counts of how nodes have been served by the node cache.
+// They are all zero unless the tree was opened with CacheSize or PinLevels.
+func (t *Tree) CacheStats() CacheStats {
+	if t.cache == nil {
+		return CacheStats{}
+	}
+	return t.cache.stats()
+}
+
+// Node reads the node at the given offset. Reads are positional, so a Tree
+// is safe for concurrent queries from multiple goroutines.
 func (t *Tree) Node(id int64) (Node, error) {
-	_, err := t.fh.Seek(id, 0)
+	if t.cache == nil {
+		return t.readNode(id)
+	}
+	if n, ok := t.cache.get(id); ok {
+		return n, nil
+	}
+	n, err := t.readNode(id)
 	if err != nil {
 		return Node{}, err
 	}
-	data := make([]byte, t.nodelen)
-	_, err = io.ReadFull(t.fh, data)
+	t.cache.add(id, n, n.size(t.maxDataLen, t.bucketed))
+	return n, nil
+}
+
+func (t *Tree) readNode(id int64) (Node, error) {
+	if id < headerSize || id+t.nodelen > t.filelen {
+		return Node{}, errClass.New("node offset %d out of range", id)
+	}
+	data, err := t.read(id, t.nodelen)
 	if err != nil {
 		return Node{}, err
 	}
-	return parseNode(data)
+	if t.bucketed {
+		bucketLen := parseBucketLen(data, int(t.nodelen))
+		if bucketLen > 0 {
+			data, err = t.read(id, t.nodelen+
+				int64(bucketLen*pointSize(t.dims, t.maxDataLen)))
+			if err != nil {
+				return Node{}, err
+			}
+		}
+	}
+	return parseNode(data, t.bucketed)
+}
+
+func (t *Tree) read(offset, length int64) ([]byte, error) {
+	if offset+length > t.filelen {
+		return nil, errClass.New("read past end of tree file")
+	}
+	if t.mapped != nil {
+		return t.mapped[offset : offset+length], nil
+	}
+	data := make([]byte, length)
+	_, err := t.fh.ReadAt(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// nodeReader returns a reader over every serialized node in the tree, in file
+// order.
+func (t *Tree) nodeReader() io.Reader {
+	if t.mapped != nil {
+		return bytes.NewReader(t.mapped[headerSize:])
+	}
+	return bufio.NewReader(io.NewSectionReader(t.fh, headerSize,
+		t.filelen-headerSize))
+}
+
+// scanNodes calls fn with every node in the tree and its offset, in file
+// order.
+func (t *Tree) scanNodes(ctx context.Context,
+	fn func(offset int64, n *Node) error) error {
+	buf := t.nodeReader()
+	offset := int64(headerSize)
+	for i := 0; ; i++ {
+		if i%scanCheckInterval == 0 {
+			err := ctx.Err()
+			if err != nil {
+				return err
+			}
+		}
+		n, _, err := parseNodeFromReader(buf, t.bucketed)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		err = fn(offset, &n)
+		if err != nil {
+			return err
+		}
+		offset += n.size(t.maxDataLen, t.bucketed)
+	}
+}
+
+// scan calls fn with every point in the tree that hasn't been deleted, in
+// file order.
+func (t *Tree) scan(ctx context.Context, fn func(p Point) error) error {
+	return t.scanNodes(ctx, func(offset int64, n *Node) error {
+		return t.each(offset, n, func(p Point, _ int64) error {
+			return fn(p)
+		})
+	})
+}
+
+// each calls fn with every point in n, the node at offset, that hasn't been
+// deleted, along with the point's own offset in the tree file.
+func (t *Tree) each(offset int64, n *Node,
+	fn func(p Point, offset int64) error) error {
+	pointOffset := offset
+	for i := -1; i < len(n.Bucket); i++ {
+		p := n.Point
+		if i >= 0 {
+			p = n.Bucket[i]
+			pointOffset = offset + t.nodelen +
+				int64(i*pointSize(t.dims, t.maxDataLen))
+		}
+		if t.tombstones.contains(pointOffset) {
+			continue
+		}
+		err := fn(p, pointOffset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type PointDistance struct {
@@ -165,40 +409,204 @@ func (h *maxHeap) Pop() (i interface{}) {
 	return i
 }
 
+// offer adds p to the heap if there is room or if it is closer than the
+// current furthest point.
+func (h *maxHeap) offer(p Point, dist float64) {
+	if h.Cap() == 0 {
+		return
+	}
+	if h.Len() < h.Cap() || dist < h.Max().Distance {
+		for h.Len() >= h.Cap() {
+			heap.Pop(h)
+		}
+		heap.Push(h, PointDistance{
+			Point:    p,
+			Distance: dist})
+	}
+}
+
+// SearchOptions control how a search is performed.
+type SearchOptions struct {
+	// Metric measures distances between points. nil means Euclidean.
+	Metric Metric
+
+	// Epsilon, if positive, makes nearest neighbor searches approximate: a
+	// subtree is skipped unless it could hold a point closer than the
+	// current nth closest point divided by 1+Epsilon. Every result is then
+	// within a factor of 1+Epsilon of the true nth closest distance. The
+	// factor applies to true distances rather than to what Metric reports,
+	// so for Euclidean, which reports squared distances, an Epsilon of 0.1
+	// allows results whose squared distance is up to 1.21 times too large.
+	// Metrics other than the built-in ones are assumed to report true
+	// distances.
+	Epsilon float64
+
+	// MaxVisits, if positive, makes nearest neighbor searches approximate by
+	// stopping them after visiting MaxVisits nodes.
+	MaxVisits int
+
+	// Filter, if set, restricts results to points for which it returns true.
+	// Points that don't match are still used to navigate the tree, so a
+	// selective filter doesn't reduce the number of results returned.
+	Filter func(p Point) bool
+}
+
+// approximate returns whether the options call for an approximate search,
+// which visits nodes in best-bin-first order so the most promising nodes
+// are visited before the search is cut short.
+func (opts *SearchOptions) approximate() bool {
+	return opts != nil && (opts.Epsilon > 0 || opts.MaxVisits > 0)
+}
+
+func (opts *SearchOptions) metric() Metric {
+	if opts == nil || opts.Metric == nil {
+		return Euclidean{}
+	}
+	return opts.Metric
+}
+
+// query is the state shared by the search functions for a single search.
+type query struct {
+	ctx    context.Context
+	p      Point
+	m      Metric
+	filter func(p Point) bool
+}
+
+func (t *Tree) checkQuery(p Point) error {
+	if len(p.Pos) != t.dims {
+		return errClass.New("query has wrong dimension: %d, expected %d",
+			len(p.Pos), t.dims)
+	}
+	return nil
+}
+
+func (t *Tree) newQuery(ctx context.Context, p Point, opts *SearchOptions) (
+	*query, error) {
+	err := t.checkQuery(p)
+	if err != nil {
+		return nil, err
+	}
+	return newQuery(ctx, p, opts)
+}
+
+// newQuery returns a query for p, which must already have been checked to
+// have the right number of dimensions.
+func newQuery(ctx context.Context, p Point, opts *SearchOptions) (*query,
+	error) {
+	q := &query{ctx: ctx, p: p, m: opts.metric()}
+	err := validateMetric(q.m, len(p.Pos))
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil {
+		q.filter = opts.Filter
+	}
+	return q, nil
+}
+
+// visit reads the node at node_offset, unless the query's context is done.
+func (t *Tree) visit(q *query, node_offset int64) (Node, error) {
+	err := q.ctx.Err()
+	if err != nil {
+		return Node{}, err
+	}
+	return t.Node(node_offset)
+}
+
+// distance returns the distance from the query point to p, and whether p is
+// admissible as a result at all.
+func (q *query) distance(p *Point) (dist float64, ok bool) {
+	if q.filter != nil && !q.filter(*p) {
+		return 0, false
+	}
+	return q.m.Distance(q.p.Pos, p.Pos), true
+}
+
+// offer offers every admissible point in n, the node at offset, to h.
+func (t *Tree) offer(q *query, h *maxHeap, offset int64, n *Node) {
+	t.each(offset, n, func(p Point, _ int64) error {
+		if dist, ok := q.distance(&p); ok {
+			h.offer(p, dist)
+		}
+		return nil
+	})
+}
+
+// split returns the children of n in the order they should be searched, along
+// with a lower bound on the distance to anything in the far child.
+func (q *query) split(n *Node) (near, far int64, farBound float64) {
+	c := q.p.Pos[n.Dim] - n.Point.Pos[n.Dim]
+	near, far = n.Left, n.Right
+	if c > 0 {
+		near, far = far, near
+	}
+	return near, far, q.m.PlaneDistance(c, int(n.Dim))
+}
+
 // NearestExhaustive just scans every point. This might be faster if your data
 // has high dimensionality.
 func (t *Tree) NearestExhaustive(p Point, n int) ([]PointDistance, error) {
-	h := make(maxHeap, 0, n)
-	_, err := t.fh.Seek(0, 0)
+	return t.NearestExhaustiveWithOptions(p, n, nil)
+}
+
+// NearestExhaustiveWithOptions is like NearestExhaustive but allows for
+// configuring the search. A nil opts is the same as NearestExhaustive.
+func (t *Tree) NearestExhaustiveWithOptions(p Point, n int,
+	opts *SearchOptions) ([]PointDistance, error) {
+	return t.NearestExhaustiveContext(context.Background(), p, n, opts)
+}
+
+// NearestExhaustiveContext is like NearestExhaustiveWithOptions but stops
+// early if ctx is done, returning ctx.Err().
+func (t *Tree) NearestExhaustiveContext(ctx context.Context, p Point, n int,
+	opts *SearchOptions) ([]PointDistance, error) {
+	q, err := t.newQuery(ctx, p, opts)
 	if err != nil {
 		return nil, err
 	}
-	buf := bufio.NewReader(t.fh)
-	for {
-		n, _, err := parseNodeFromReader(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
-		dist := p.distanceSquared(&n.Point)
-		if h.Len() < h.Cap() || dist < h.Max().Distance {
-			for h.Len() >= h.Cap() {
-				heap.Pop(&h)
-			}
-			heap.Push(&h, PointDistance{
-				Point:    n.Point,
-				Distance: dist})
-		}
+	h := make(maxHeap, 0, n)
+	err = t.scanNodes(ctx, func(offset int64, n *Node) error {
+		t.offer(q, &h, offset, n)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	sort.Sort(sort.Reverse(&h))
 	return h, nil
 }
 
+// Nearest returns the n closest points to p, ordered by increasing distance.
+// Distance is the squared Euclidean distance.
 func (t *Tree) Nearest(p Point, n int) ([]PointDistance, error) {
+	return t.NearestWithOptions(p, n, nil)
+}
+
+// NearestWithOptions is like Nearest but allows for configuring the search.
+// A nil opts is the same as Nearest.
+func (t *Tree) NearestWithOptions(p Point, n int, opts *SearchOptions) (
+	[]PointDistance, error) {
+	return t.NearestContext(context.Background(), p, n, opts)
+}
+
+// NearestContext is like NearestWithOptions but stops early if ctx is done,
+// returning ctx.Err().
+func (t *Tree) NearestContext(ctx context.Context, p Point, n int,
+	opts *SearchOptions) ([]PointDistance, error) {
+	q, err := t.newQuery(ctx, p, opts)
+	if err != nil {
+		return nil, err
+	}
 	h := make(maxHeap, 0, n)
-	err := t.search(t.root, p, &h)
+	if n <= 0 {
+		return h, nil
+	}
+	if opts.approximate() {
+		err = t.searchBestBin(q, &h, opts.Epsilon, opts.MaxVisits)
+	} else {
+		err = t.search(t.root, q, &h)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -206,51 +614,258 @@ func (t *Tree) Nearest(p Point, n int) ([]PointDistance, error) {
 	return h, nil
 }
 
-func (t *Tree) search(node_offset int64, p Point, h *maxHeap) error {
+func (t *Tree) search(node_offset int64, q *query, h *maxHeap) error {
 	if node_offset == -1 {
 		return nil
 	}
 
-	n, err := t.Node(node_offset)
+	n, err := t.visit(q, node_offset)
 	if err != nil {
 		return err
 	}
 
-	c := p.Pos[n.Dim] - n.Point.Pos[n.Dim]
-	dist := p.distanceSquared(&n.Point)
+	t.offer(q, h, node_offset, &n)
+	near, far, farBound := q.split(&n)
 
-	if h.Len() < h.Cap() || dist < h.Max().Distance {
-		for h.Len() >= h.Cap() {
-			heap.Pop(h)
-		}
-		heap.Push(h, PointDistance{
-			Point:    n.Point,
-			Distance: dist})
+	err = t.search(near, q, h)
+	if err != nil {
+		return err
+	}
+	if h.Len() < h.Cap() || farBound <= h.Max().Distance {
+		return t.search(far, q, h)
+	}
+	return nil
+}
+
+// nodeBound is a node along with a lower bound on the distance between it and
+// a query point. If point is set, it is instead a single point at exactly
+// that distance.
+type nodeBound struct {
+	offset int64
+	bound  float64
+	point  *Point
+}
+
+// nodeQueue is a priority queue of nodes, closest lower bound first.
+type nodeQueue []nodeBound
+
+func (q *nodeQueue) Len() int { return len(*q) }
+
+func (q *nodeQueue) Less(i, j int) bool {
+	return (*q)[i].bound < (*q)[j].bound
+}
+
+func (q *nodeQueue) Swap(i, j int) {
+	(*q)[i], (*q)[j] = (*q)[j], (*q)[i]
+}
+
+func (q *nodeQueue) Push(x interface{}) {
+	(*q) = append(*q, x.(nodeBound))
+}
+
+func (q *nodeQueue) Pop() (i interface{}) {
+	i, *q = (*q)[len(*q)-1], (*q)[:len(*q)-1]
+	return i
+}
+
+// searchBestBin is like search, but visits nodes in order of their lower
+// bound distance from the query point instead of depth-first.
+func (t *Tree) searchBestBin(q *query, h *maxHeap, epsilon float64,
+	maxVisits int) error {
+	if t.root == -1 {
+		return nil
 	}
 
-	if c <= 0 {
-		err = t.search(n.Left, p, h)
+	slack := scaleDistance(q.m, 1+epsilon)
+	queue := nodeQueue{{offset: t.root}}
+	for visits := 0; queue.Len() > 0; visits++ {
+		if maxVisits > 0 && visits >= maxVisits {
+			break
+		}
+		nb := heap.Pop(&queue).(nodeBound)
+		if h.Len() >= h.Cap() && nb.bound*slack > h.Max().Distance {
+			break
+		}
+
+		n, err := t.visit(q, nb.offset)
 		if err != nil {
 			return err
 		}
-		if c*c <= h.Max().Distance {
-			err = t.search(n.Right, p, h)
-			if err != nil {
-				return err
-			}
+
+		t.offer(q, h, nb.offset, &n)
+		near, far, farBound := q.split(&n)
+		if near != -1 {
+			heap.Push(&queue, nodeBound{offset: near, bound: nb.bound})
 		}
+		if far != -1 {
+			heap.Push(&queue, nodeBound{offset: far,
+				bound: math.Max(nb.bound, farBound)})
+		}
+	}
+	return nil
+}
+
+// NearestCosine returns the n points with the highest cosine similarity to p,
+// ordered by decreasing similarity. Distance is the cosine similarity. The
+// tree must have been built with BuildOptions.Normalize.
+func (t *Tree) NearestCosine(p Point, n int) ([]PointDistance, error) {
+	return t.NearestCosineWithOptions(p, n, nil)
+}
+
+// NearestCosineWithOptions is like NearestCosine but allows for configuring
+// the search. The Metric option must be unset or Euclidean.
+func (t *Tree) NearestCosineWithOptions(p Point, n int, opts *SearchOptions) (
+	[]PointDistance, error) {
+	if !t.normalized {
+		return nil, errClass.New("cosine search requires a normalized tree")
+	}
+	if _, ok := opts.metric().(Euclidean); !ok {
+		return nil, errClass.New("cosine search requires the Euclidean metric")
+	}
+	err := t.checkQuery(p)
+	if err != nil {
+		return nil, err
+	}
+	p.Pos, err = Normalize(p.Pos)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := t.NearestWithOptions(p, n, opts)
+	if err != nil {
+		return nil, err
+	}
+	// for unit vectors, |a-b|^2 = 2 - 2cos(a, b)
+	for i := range rv {
+		rv[i].Distance = 1 - rv[i].Distance/2
+	}
+	return rv, nil
+}
+
+// Within returns every point within radius of p, ordered by increasing
+// distance. As with Nearest, Distance is the squared Euclidean distance.
+func (t *Tree) Within(p Point, radius float64) ([]PointDistance, error) {
+	return t.WithinWithOptions(p, radius*radius, nil)
+}
+
+// WithinWithOptions returns every point within maxDistance of p, ordered by
+// increasing distance. maxDistance is in the units opts.Metric reports, so
+// it is a squared distance for Euclidean. Epsilon and MaxVisits don't apply.
+func (t *Tree) WithinWithOptions(p Point, maxDistance float64,
+	opts *SearchOptions) ([]PointDistance, error) {
+	return t.WithinContext(context.Background(), p, maxDistance, opts)
+}
+
+// WithinContext is like WithinWithOptions but stops early if ctx is done,
+// returning ctx.Err().
+func (t *Tree) WithinContext(ctx context.Context, p Point,
+	maxDistance float64, opts *SearchOptions) ([]PointDistance, error) {
+	q, err := t.newQuery(ctx, p, opts)
+	if err != nil {
+		return nil, err
+	}
+	var rv maxHeap
+	err = t.searchRadius(t.root, q, maxDistance, &rv)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(&rv))
+	return rv, nil
+}
+
+func (t *Tree) searchRadius(node_offset int64, q *query, bound float64,
+	rv *maxHeap) error {
+	if node_offset == -1 {
+		return nil
+	}
+
+	n, err := t.visit(q, node_offset)
+	if err != nil {
+		return err
+	}
+
+	t.each(node_offset, &n, func(np Point, _ int64) error {
+		dist, ok := q.distance(&np)
+		if ok && dist <= bound {
+			*rv = append(*rv, PointDistance{
+				Point:    np,
+				Distance: dist})
+		}
+		return nil
+	})
+
+	near, far, farBound := q.split(&n)
+
+	err = t.searchRadius(near, q, bound, rv)
+	if err != nil {
+		return err
+	}
+	if farBound <= bound {
+		return t.searchRadius(far, q, bound, rv)
+	}
+	return nil
+}
+
+// Range returns every point inside the axis-aligned box described by min and
+// max. Bounds are inclusive.
+func (t *Tree) Range(min, max []float64) (rv []Point, err error) {
+	err = t.RangeFunc(min, max, func(p Point) error {
+		rv = append(rv, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// RangeFunc is like Range but calls fn with each point as it is found instead
+// of collecting them. If fn returns an error, the search stops and returns
+// that error.
+func (t *Tree) RangeFunc(min, max []float64, fn func(Point) error) error {
+	if len(min) != len(max) {
+		return errClass.New("range bounds have different dimensions: %d and %d",
+			len(min), len(max))
+	}
+	return t.searchRange(t.root, min, max, func(p Point, _ int64) error {
+		return fn(p)
+	})
+}
+
+func (t *Tree) searchRange(node_offset int64, min, max []float64,
+	fn func(p Point, offset int64) error) error {
+	if node_offset == -1 {
 		return nil
 	}
 
-	err = t.search(n.Right, p, h)
+	n, err := t.Node(node_offset)
 	if err != nil {
 		return err
 	}
-	if c*c <= h.Max().Distance {
-		err = t.search(n.Left, p, h)
+
+	if len(n.Point.Pos) != len(min) {
+		return errClass.New("range has wrong dimension: %d, expected %d",
+			len(min), len(n.Point.Pos))
+	}
+
+	err = t.each(node_offset, &n, func(np Point, offset int64) error {
+		if np.inBox(min, max) {
+			return fn(np, offset)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	split := n.Point.Pos[n.Dim]
+	if min[n.Dim] <= split {
+		err = t.searchRange(n.Left, min, max, fn)
 		if err != nil {
 			return err
 		}
 	}
+	if max[n.Dim] > split {
+		return t.searchRange(n.Right, min, max, fn)
+	}
 	return nil
 }
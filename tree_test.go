@@ -15,8 +15,20 @@
 package dkdtree
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -93,3 +105,1948 @@ func TestTree(t *testing.T) {
 		}
 	}
 }
+
+func createTestTree(t *testing.T, fs *baseFS, dims, maxData, points int) (
+	*Tree, []Point) {
+	return createTestTreeWithOptions(t, fs, dims, maxData, points, nil)
+}
+
+func createTestTreeWithOptions(t *testing.T, fs *baseFS, dims, maxData,
+	points int, opts *BuildOptions) (*Tree, []Point) {
+	log, err := NewPointSet(fs.Temp(), dims, maxData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	all := make([]Point, 0, points)
+	for i := 0; i < points; i++ {
+		p := NewPoint(dims, maxData)
+		err = log.Add(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, p)
+	}
+
+	tree, err := CreateTreeWithOptions(fs.Temp(), fs.Temp(), log, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree, all
+}
+
+func TestWithin(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 3
+	tree, all := createTestTree(t, fs, dims, 20, 500)
+	defer tree.Close()
+
+	for j := 0; j < 20; j++ {
+		q := NewPoint(dims, 20)
+		radius := rand.Float64() / 2
+
+		within, err := tree.Within(q, radius)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := 0
+		for _, p := range all {
+			if q.distanceSquared(&p) <= radius*radius {
+				expected++
+			}
+		}
+		if len(within) != expected {
+			t.Fatalf("got %d points within %f, expected %d", len(within), radius,
+				expected)
+		}
+
+		last := float64(0)
+		for _, resp := range within {
+			if resp.Distance < last || resp.Distance > radius*radius {
+				t.Fatal("results out of order or out of range")
+			}
+			last = resp.Distance
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 3
+	tree, all := createTestTree(t, fs, dims, 20, 500)
+	defer tree.Close()
+
+	for j := 0; j < 20; j++ {
+		min := make([]float64, dims)
+		max := make([]float64, dims)
+		for i := range min {
+			a, b := rand.Float64(), rand.Float64()
+			if a > b {
+				a, b = b, a
+			}
+			min[i], max[i] = a, b
+		}
+
+		found, err := tree.Range(min, max)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := 0
+		for _, p := range all {
+			if p.inBox(min, max) {
+				expected++
+			}
+		}
+		if len(found) != expected {
+			t.Fatalf("got %d points in range, expected %d", len(found), expected)
+		}
+		for _, p := range found {
+			if !p.inBox(min, max) {
+				t.Fatal("point out of range")
+			}
+		}
+	}
+
+	_, err = tree.Range(make([]float64, dims), make([]float64, dims+1))
+	if err == nil {
+		t.Fatal("expected error for mismatched bounds")
+	}
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 5
+	tree, _ := createTestTree(t, fs, dims, 20, 500)
+	defer tree.Close()
+
+	queries := make([]Point, 20)
+	expected := make([][]PointDistance, len(queries))
+	for i := range queries {
+		queries[i] = NewPoint(dims, 20)
+		expected[i], err = tree.Nearest(queries[i], 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(i int, got []PointDistance) error {
+		if len(got) != len(expected[i]) {
+			return errClass.New("got %d results, expected %d", len(got),
+				len(expected[i]))
+		}
+		for j, resp := range got {
+			if !resp.Point.equal(&expected[i][j].Point) ||
+				resp.Distance != expected[i][j].Distance {
+				return errClass.New("result mismatch for query %d", i)
+			}
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for g := 0; g < cap(errs); g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := range queries {
+				i = (i + g) % len(queries)
+				got, err := tree.Nearest(queries[i], 5)
+				if err == nil {
+					err = check(i, got)
+				}
+				if err == nil && g%4 == 0 {
+					got, err = tree.NearestExhaustive(queries[i], 5)
+					if err == nil {
+						err = check(i, got)
+					}
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestTreeHeader(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	tree, _ := createTestTree(t, fs, 4, 30, 50)
+	defer tree.Close()
+	if tree.Dims() != 4 || tree.MaxDataLen() != 30 || tree.Count() != 50 {
+		t.Fatalf("unexpected tree metadata: %d dims, %d max data len, %d count",
+			tree.Dims(), tree.MaxDataLen(), tree.Count())
+	}
+
+	empty, _ := createTestTree(t, fs, 4, 30, 0)
+	defer empty.Close()
+	if empty.Dims() != 4 || empty.Count() != 0 {
+		t.Fatal("unexpected empty tree metadata")
+	}
+	nearest, err := empty.Nearest(NewPoint(4, 30), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearest) != 0 {
+		t.Fatal("empty tree returned results")
+	}
+
+	log, err := NewPointSet(fs.Path("notatree"), 4, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = log.Add(NewPoint(4, 30))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = log.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenTree(fs.Path("notatree"))
+	if err == nil {
+		t.Fatal("expected error opening a non-tree file")
+	}
+
+	data, err := ioutil.ReadFile(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint64(data[32:], headerSize+1)
+	err = ioutil.WriteFile(fs.Path("misaligned"), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenTree(fs.Path("misaligned"))
+	if err == nil {
+		t.Fatal("expected error opening a tree with a misaligned root")
+	}
+}
+
+func TestMmap(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 5
+	tree, _ := createTestTree(t, fs, dims, 20, 300)
+	defer tree.Close()
+
+	mapped, err := OpenTreeWithOptions(tree.path, &OpenOptions{Mmap: true})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer mapped.Close()
+
+	for j := 0; j < 10; j++ {
+		q := NewPoint(dims, 20)
+		expected, err := tree.Nearest(q, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, search := range []func(Point, int) ([]PointDistance, error){
+			mapped.Nearest, mapped.NearestExhaustive} {
+			got, err := search(q, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(expected) {
+				t.Fatal("result count mismatch")
+			}
+			for i := range got {
+				if !got[i].Point.equal(&expected[i].Point) ||
+					got[i].Distance != expected[i].Distance {
+					t.Fatal("result mismatch")
+				}
+			}
+		}
+	}
+}
+
+// checkNearest compares Nearest against NearestExhaustive for a number of
+// random queries.
+func checkNearest(t *testing.T, tree *Tree, dims, maxData, queries int) {
+	for j := 0; j < queries; j++ {
+		q := NewPoint(dims, maxData)
+		nearest, err := tree.Nearest(q, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := tree.NearestExhaustive(q, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nearest) != len(expected) {
+			t.Fatalf("got %d results, expected %d", len(nearest), len(expected))
+		}
+		for i := range nearest {
+			if nearest[i].Distance != expected[i].Distance {
+				t.Fatalf("result %d has distance %f, expected %f", i,
+					nearest[i].Distance, expected[i].Distance)
+			}
+		}
+	}
+}
+
+func TestParallelBuild(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 4
+	tree, _ := createTestTreeWithOptions(t, fs, dims, 10, 5000,
+		&BuildOptions{Workers: 4})
+	defer tree.Close()
+
+	if tree.Count() != 5000 {
+		t.Fatalf("tree has %d nodes, expected 5000", tree.Count())
+	}
+	checkNearest(t, tree, dims, 10, 20)
+}
+
+func TestMemoryBuild(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 4
+	for _, budget := range []int64{
+		int64(pointSize(dims, 10)) * 100,
+		int64(pointSize(dims, 10)) * 10000} {
+		tree, _ := createTestTreeWithOptions(t, fs, dims, 10, 2000,
+			&BuildOptions{MemoryBudget: budget})
+		if tree.Count() != 2000 {
+			t.Fatalf("tree has %d nodes, expected 2000", tree.Count())
+		}
+		checkNearest(t, tree, dims, 10, 20)
+		tree.Close()
+	}
+}
+
+func TestSplitStrategies(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 3
+	for _, opts := range []*BuildOptions{
+		{Split: SplitSampled, SampleSize: 500},
+		{Split: SplitExact},
+		{Split: SplitExact, MemoryBudget: 1 << 20},
+		{Split: SplitMidpoint},
+		{Split: SplitMidpoint, MemoryBudget: 1 << 20}} {
+		tree, _ := createTestTreeWithOptions(t, fs, dims, 10, 1000, opts)
+		if tree.Count() != 1000 {
+			t.Fatalf("tree has %d nodes, expected 1000", tree.Count())
+		}
+		if tree.Depth() < 10 || tree.Depth() > 50 {
+			t.Fatalf("unexpected tree depth %d", tree.Depth())
+		}
+		if opts.Split == SplitExact && tree.Depth() != 10 {
+			t.Fatalf("exact median tree has depth %d, expected 10", tree.Depth())
+		}
+		checkNearest(t, tree, dims, 10, 10)
+		tree.Close()
+	}
+}
+
+func TestExactMedian(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	// enough points that selection needs more than one pass, with lots of
+	// duplicate values.
+	count := selectionMemory*2 + 1
+	log, err := NewPointSet(fs.Temp(), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	values := make([]float64, 0, count)
+	for i := 0; i < count; i++ {
+		v := float64(rand.Intn(1000))
+		values = append(values, v)
+		err = log.Add(Point{Pos: []float64{v}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Float64s(values)
+
+	median, err := log.exactMedian(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if median.Pos[0] != values[count/2] {
+		t.Fatalf("got median %f, expected %f", median.Pos[0], values[count/2])
+	}
+}
+
+func TestSplitDimStrategies(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	// only the last dimension has any real spread.
+	dims := 4
+	for _, opts := range []*BuildOptions{
+		{SplitDim: DimMaxVariance},
+		{SplitDim: DimMaxRange},
+		{SplitDim: DimMaxVariance, MemoryBudget: 1 << 20}} {
+		log, err := NewPointSet(fs.Temp(), dims, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 500; i++ {
+			p := Point{Pos: make([]float64, dims)}
+			for j := range p.Pos {
+				p.Pos[j] = rand.Float64() * 1e-6
+			}
+			p.Pos[dims-1] = rand.Float64()
+			err = log.Add(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tree, err := CreateTreeWithOptions(fs.Temp(), fs.Temp(), log, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := tree.Root()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root.Dim != uint32(dims-1) {
+			t.Fatalf("root split along %d, expected %d", root.Dim, dims-1)
+		}
+		checkNearest(t, tree, dims, 1, 10)
+		tree.Close()
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 3
+	for _, opts := range []*BuildOptions{
+		{BucketSize: 8},
+		{BucketSize: 8, MemoryBudget: 1 << 20},
+		{BucketSize: 8, Split: SplitMidpoint}} {
+		tree, all := createTestTreeWithOptions(t, fs, dims, 10, 1000, opts)
+		if tree.Count() != 1000 {
+			t.Fatalf("tree has %d points, expected 1000", tree.Count())
+		}
+		checkNearest(t, tree, dims, 10, 10)
+
+		q := NewPoint(dims, 10)
+		within, err := tree.Within(q, 0.3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := 0
+		for _, p := range all {
+			if q.distanceSquared(&p) <= 0.3*0.3 {
+				expected++
+			}
+		}
+		if len(within) != expected {
+			t.Fatalf("got %d points within radius, expected %d", len(within),
+				expected)
+		}
+
+		min, max := []float64{0, 0, 0}, []float64{0.5, 0.5, 0.5}
+		found, err := tree.Range(min, max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = 0
+		for _, p := range all {
+			if p.inBox(min, max) {
+				expected++
+			}
+		}
+		if len(found) != expected {
+			t.Fatalf("got %d points in range, expected %d", len(found), expected)
+		}
+
+		mapped, err := OpenTreeWithOptions(tree.path, &OpenOptions{Mmap: true})
+		if err == nil {
+			checkNearest(t, mapped, dims, 10, 10)
+			mapped.Close()
+		}
+		tree.Close()
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 4
+	tree, all := createTestTreeWithOptions(t, fs, dims, 10, 1000,
+		&BuildOptions{BucketSize: 4})
+	defer tree.Close()
+
+	for _, m := range []Metric{
+		Euclidean{},
+		Manhattan{},
+		Chebyshev{},
+		WeightedEuclidean{Weights: []float64{1, 10, 0.1, 0}},
+		Minkowski{P: 3}} {
+		opts := &SearchOptions{Metric: m}
+		for j := 0; j < 10; j++ {
+			q := NewPoint(dims, 10)
+			nearest, err := tree.NearestWithOptions(q, 10, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := tree.NearestExhaustiveWithOptions(q, 10, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nearest) != 10 || len(expected) != 10 {
+				t.Fatalf("%T: got %d results, expected 10", m, len(nearest))
+			}
+			for i := range nearest {
+				if nearest[i].Distance != expected[i].Distance {
+					t.Fatalf("%T: result %d has distance %f, expected %f", m, i,
+						nearest[i].Distance, expected[i].Distance)
+				}
+			}
+
+			bound := nearest[len(nearest)-1].Distance
+			within, err := tree.WithinWithOptions(q, bound, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			count := 0
+			for _, p := range all {
+				if m.Distance(q.Pos, p.Pos) <= bound {
+					count++
+				}
+			}
+			if len(within) != count {
+				t.Fatalf("%T: got %d points within %f, expected %d", m,
+					len(within), bound, count)
+			}
+		}
+	}
+
+	_, err = tree.Nearest(NewPoint(dims+1, 10), 10)
+	if err == nil {
+		t.Fatal("expected error for query with wrong dimension")
+	}
+
+	for _, m := range []Metric{
+		WeightedEuclidean{Weights: make([]float64, dims-1)},
+		WeightedEuclidean{Weights: []float64{1, -1, 1, 1}},
+		WeightedEuclidean{Weights: []float64{1, math.NaN(), 1, 1}},
+		Minkowski{P: 0},
+		Minkowski{P: math.Inf(1)},
+	} {
+		opts := &SearchOptions{Metric: m}
+		q := NewPoint(dims, 10)
+		_, err = tree.NearestWithOptions(q, 10, opts)
+		if err == nil {
+			t.Fatalf("%#v: expected invalid metric error", m)
+		}
+		_, err = tree.WithinWithOptions(q, 1, opts)
+		if err == nil {
+			t.Fatalf("%#v: expected invalid metric error", m)
+		}
+	}
+}
+
+func TestCosine(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 5
+	tree, all := createTestTreeWithOptions(t, fs, dims, 10, 500,
+		&BuildOptions{Normalize: true})
+	defer tree.Close()
+	if !tree.Normalized() {
+		t.Fatal("tree isn't normalized")
+	}
+
+	cosine := func(a, b []float64) float64 {
+		var dot, na, nb float64
+		for i := range a {
+			dot += a[i] * b[i]
+			na += a[i] * a[i]
+			nb += b[i] * b[i]
+		}
+		return dot / math.Sqrt(na*nb)
+	}
+
+	for j := 0; j < 10; j++ {
+		q := NewPoint(dims, 10)
+		for i := range q.Pos {
+			q.Pos[i] *= 10
+		}
+		nearest, err := tree.NearestCosine(q, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sims := make([]float64, 0, len(all))
+		for _, p := range all {
+			sims = append(sims, cosine(q.Pos, p.Pos))
+		}
+		sort.Sort(sort.Reverse(sort.Float64Slice(sims)))
+
+		if len(nearest) != 5 {
+			t.Fatalf("got %d results, expected 5", len(nearest))
+		}
+		for i, resp := range nearest {
+			if math.Abs(resp.Distance-sims[i]) > 1e-9 {
+				t.Fatalf("result %d has similarity %f, expected %f", i,
+					resp.Distance, sims[i])
+			}
+		}
+	}
+
+	unnormalized, _ := createTestTree(t, fs, dims, 10, 10)
+	defer unnormalized.Close()
+	_, err = unnormalized.NearestCosine(NewPoint(dims, 10), 5)
+	if err == nil {
+		t.Fatal("expected error for cosine search on unnormalized tree")
+	}
+}
+
+func TestApproximate(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 8
+	tree, _ := createTestTree(t, fs, dims, 10, 2000)
+	defer tree.Close()
+
+	for j := 0; j < 10; j++ {
+		q := NewPoint(dims, 10)
+		expected, err := tree.Nearest(q, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a visit budget as large as the tree gives exact results.
+		exact, err := tree.NearestWithOptions(q, 10,
+			&SearchOptions{MaxVisits: 2000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range exact {
+			if exact[i].Distance != expected[i].Distance {
+				t.Fatalf("result %d has distance %f, expected %f", i,
+					exact[i].Distance, expected[i].Distance)
+			}
+		}
+
+		// Epsilon bounds true distances, not the squared distances
+		// Euclidean reports.
+		approx, err := tree.NearestWithOptions(q, 10,
+			&SearchOptions{Epsilon: 0.5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(approx) != 10 {
+			t.Fatalf("got %d results, expected 10", len(approx))
+		}
+		bound := 1.5 * math.Sqrt(expected[9].Distance)
+		for i := range approx {
+			if math.Sqrt(approx[i].Distance) > bound {
+				t.Fatalf("result %d has distance %f, beyond bound %f", i,
+					math.Sqrt(approx[i].Distance), bound)
+			}
+		}
+
+		manhattan, err := tree.NearestWithOptions(q, 10,
+			&SearchOptions{Metric: Manhattan{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		approx, err = tree.NearestWithOptions(q, 10,
+			&SearchOptions{Metric: Manhattan{}, Epsilon: 0.5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range approx {
+			if approx[i].Distance > manhattan[9].Distance*1.5 {
+				t.Fatalf("result %d has distance %f, beyond bound %f", i,
+					approx[i].Distance, manhattan[9].Distance*1.5)
+			}
+		}
+
+		budget, err := tree.NearestWithOptions(q, 10,
+			&SearchOptions{MaxVisits: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(budget) != 5 {
+			t.Fatalf("got %d results from 5 visits, expected 5", len(budget))
+		}
+	}
+}
+
+func TestNearestIter(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 3
+	tree, _ := createTestTreeWithOptions(t, fs, dims, 10, 500,
+		&BuildOptions{BucketSize: 4})
+	defer tree.Close()
+
+	for j := 0; j < 10; j++ {
+		q := NewPoint(dims, 10)
+		expected, err := tree.NearestExhaustive(q, 500)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		it, err := tree.NearestIter(q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for it.Next() {
+			got := it.PointDistance()
+			if got.Distance != expected[count].Distance {
+				t.Fatalf("result %d has distance %f, expected %f", count,
+					got.Distance, expected[count].Distance)
+			}
+			count++
+		}
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		if count != len(expected) {
+			t.Fatalf("iterated over %d points, expected %d", count, len(expected))
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 3
+	log, err := NewPointSet(fs.Temp(), dims, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		p := NewPoint(dims, 1)
+		p.Data = []byte{byte(i % 50)}
+		err = log.Add(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree, err := CreateTree(fs.Temp(), fs.Temp(), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	opts := &SearchOptions{Filter: func(p Point) bool { return p.Data[0] == 7 }}
+	for j := 0; j < 10; j++ {
+		q := NewPoint(dims, 1)
+		nearest, err := tree.NearestWithOptions(q, 10, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := tree.NearestExhaustiveWithOptions(q, 10, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		approx, err := tree.NearestWithOptions(q, 10,
+			&SearchOptions{Filter: opts.Filter, MaxVisits: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nearest) != 10 || len(expected) != 10 || len(approx) != 10 {
+			t.Fatalf("got %d, %d and %d results, expected 10", len(nearest),
+				len(expected), len(approx))
+		}
+		for i := range nearest {
+			if nearest[i].Data[0] != 7 || approx[i].Data[0] != 7 {
+				t.Fatal("filtered point in results")
+			}
+			if nearest[i].Distance != expected[i].Distance ||
+				approx[i].Distance != expected[i].Distance {
+				t.Fatalf("result %d has distance %f, expected %f", i,
+					nearest[i].Distance, expected[i].Distance)
+			}
+		}
+
+		within, err := tree.WithinWithOptions(q, expected[9].Distance, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(within) != 10 {
+			t.Fatalf("got %d points within radius, expected 10", len(within))
+		}
+
+		it, err := tree.NearestIter(q, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for it.Next() {
+			if it.PointDistance().Data[0] != 7 {
+				t.Fatal("filtered point in iterator")
+			}
+			count++
+		}
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		if count != 20 {
+			t.Fatalf("iterated over %d points, expected 20", count)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 3
+	tree, _ := createTestTree(t, fs, dims, 10, 500)
+	defer tree.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	q := NewPoint(dims, 10)
+	_, err = tree.NearestContext(ctx, q, 10, nil)
+	if err != context.Canceled {
+		t.Fatalf("got %v, expected context.Canceled", err)
+	}
+	_, err = tree.NearestExhaustiveContext(ctx, q, 10, nil)
+	if err != context.Canceled {
+		t.Fatalf("got %v, expected context.Canceled", err)
+	}
+	_, err = tree.WithinContext(ctx, q, 0.1, nil)
+	if err != context.Canceled {
+		t.Fatalf("got %v, expected context.Canceled", err)
+	}
+
+	log, err := NewPointSet(fs.Temp(), dims, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		err = log.Add(NewPoint(dims, 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmpdir := fs.Temp()
+	_, err = CreateTreeContext(ctx, fs.Path("canceled"), tmpdir, log,
+		&BuildOptions{Workers: 2})
+	if err != context.Canceled {
+		t.Fatalf("got %v, expected context.Canceled", err)
+	}
+	leftover, err := filepath.Glob(filepath.Join(tmpdir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftover) != 0 {
+		t.Fatalf("temporary files left behind: %v", leftover)
+	}
+	if _, err := os.Stat(fs.Path("canceled")); !os.IsNotExist(err) {
+		t.Fatal("partial tree file left behind")
+	}
+
+	// cancel while the points are still being produced, and again once the
+	// producer is done and the tree itself is being built.
+	for _, cancelAt := range []int{5000, 10000} {
+		ctx, cancel := context.WithCancel(context.Background())
+		i := 0
+		next := func() (Point, error) {
+			i++
+			if i == cancelAt {
+				cancel()
+			}
+			if i > 10000 {
+				return Point{}, io.EOF
+			}
+			return NewPoint(dims, 10), nil
+		}
+		tmpdir := fs.Temp()
+		_, err = CreateTreeFromFunc(ctx, fs.Path("canceled"), tmpdir, dims, 10,
+			next, nil)
+		cancel()
+		if err != context.Canceled {
+			t.Fatalf("got %v, expected context.Canceled", err)
+		}
+		leftover, err := filepath.Glob(filepath.Join(tmpdir, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(leftover) != 0 {
+			t.Fatalf("temporary files left behind: %v", leftover)
+		}
+		if _, err := os.Stat(fs.Path("canceled")); !os.IsNotExist(err) {
+			t.Fatal("partial tree file left behind")
+		}
+	}
+}
+
+func TestNearestBatch(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 3
+	tree, _ := createTestTreeWithOptions(t, fs, dims, 10, 1000,
+		&BuildOptions{BucketSize: 4})
+	defer tree.Close()
+
+	queries := make([]Point, 50)
+	for i := range queries {
+		queries[i] = NewPoint(dims, 10)
+	}
+
+	for _, opts := range []*SearchOptions{
+		nil,
+		{Metric: Manhattan{}},
+		{Filter: func(p Point) bool { return p.Pos[0] < 0.5 }},
+	} {
+		results, err := tree.NearestBatchWithOptions(queries, 10, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(queries) {
+			t.Fatalf("got %d result sets, expected %d", len(results),
+				len(queries))
+		}
+		for j, q := range queries {
+			expected, err := tree.NearestExhaustiveWithOptions(q, 10, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results[j]) != len(expected) {
+				t.Fatalf("got %d results, expected %d", len(results[j]),
+					len(expected))
+			}
+			for i := range expected {
+				if results[j][i].Distance != expected[i].Distance {
+					t.Fatalf("query %d result %d has distance %f, expected %f", j,
+						i, results[j][i].Distance, expected[i].Distance)
+				}
+			}
+		}
+	}
+}
+
+func TestNodeCache(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 3
+	tree, _ := createTestTreeWithOptions(t, fs, dims, 10, 1000,
+		&BuildOptions{BucketSize: 4})
+	defer tree.Close()
+
+	cacheSize := 20 * tree.nodelen
+	cached, err := OpenTreeWithOptions(tree.path,
+		&OpenOptions{CacheSize: cacheSize, PinLevels: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cached.Close()
+	if len(cached.cache.pinned) != 7 {
+		t.Fatalf("pinned %d nodes, expected 7", len(cached.cache.pinned))
+	}
+
+	for j := 0; j < 20; j++ {
+		q := NewPoint(dims, 10)
+		expected, err := tree.Nearest(q, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := cached.Nearest(q, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(expected) {
+			t.Fatal("result count mismatch")
+		}
+		for i := range got {
+			if !got[i].Point.equal(&expected[i].Point) ||
+				got[i].Distance != expected[i].Distance {
+				t.Fatal("result mismatch")
+			}
+		}
+	}
+
+	stats := cached.CacheStats()
+	if stats.Hits < 20 || stats.Misses == 0 {
+		t.Fatalf("unexpected cache stats: %+v", stats)
+	}
+	if stats.Bytes > cacheSize {
+		t.Fatalf("cache holds %d bytes, more than %d", stats.Bytes, cacheSize)
+	}
+	if tree.CacheStats() != (CacheStats{}) {
+		t.Fatal("uncached tree has cache stats")
+	}
+}
+
+func TestDynamicTree(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 3
+	opts := &DynamicOptions{BufferSize: 100}
+	d, err := OpenDynamicTree(fs.Path("dynamic"), dims, 10, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []Point
+	for i := 0; i < 1050; i++ {
+		p := NewPoint(dims, 10)
+		err = d.Add(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, p)
+	}
+	if d.Count() != 1050 {
+		t.Fatalf("got count %d, expected 1050", d.Count())
+	}
+	// 10 merges of 100 points leave levels 1 and 3 full, like binary 1010.
+	if len(d.levels) != 4 || d.levels[0] != nil || d.levels[1] == nil ||
+		d.levels[2] != nil || d.levels[3] == nil {
+		t.Fatalf("unexpected levels: %v", d.levels)
+	}
+
+	check := func(d *DynamicTree) {
+		for j := 0; j < 10; j++ {
+			q := NewPoint(dims, 10)
+			distances := make([]float64, 0, len(all))
+			for i := range all {
+				distances = append(distances, q.distanceSquared(&all[i]))
+			}
+			sort.Float64s(distances)
+
+			nearest, err := d.Nearest(q, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nearest) != 10 {
+				t.Fatalf("got %d results, expected 10", len(nearest))
+			}
+			for i := range nearest {
+				if nearest[i].Distance != distances[i] {
+					t.Fatalf("result %d has distance %f, expected %f", i,
+						nearest[i].Distance, distances[i])
+				}
+			}
+
+			within, err := d.WithinWithOptions(q, distances[19], nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(within) != 20 {
+				t.Fatalf("got %d points within radius, expected 20",
+					len(within))
+			}
+		}
+	}
+	check(d)
+
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenDynamicTree(fs.Path("dynamic"), dims+1, 10, opts)
+	if err == nil {
+		t.Fatal("expected dimension mismatch error")
+	}
+	d, err = OpenDynamicTree(fs.Path("dynamic"), dims, 10, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.Count() != 1050 {
+		t.Fatalf("got count %d after reopening, expected 1050", d.Count())
+	}
+	check(d)
+
+	_, err = OpenDynamicTree(fs.Path("dynamic"), dims, 10, opts)
+	if err == nil {
+		t.Fatal("expected error opening a DynamicTree that is already open")
+	}
+}
+
+func TestDynamicTreeReusedBuffer(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	d, err := OpenDynamicTree(fs.Path("dynamic"), 2, 4,
+		&DynamicOptions{BufferSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	pos := make([]float64, 2)
+	data := make([]byte, 1)
+	for i := 0; i < 10; i++ {
+		pos[0], data[0] = float64(i), byte(i)
+		err = d.Add(Point{Pos: pos, Data: data})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nearest, err := d.Nearest(Point{Pos: []float64{0, 0}}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range nearest {
+		if result.Pos[0] != float64(i) || result.Data[0] != byte(i) {
+			t.Fatalf("result %d is %v, expected [%d 0]", i, result.Point, i)
+		}
+	}
+}
+
+func TestDynamicTreeCrashedMerge(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dir := fs.Path("dynamic")
+	opts := &DynamicOptions{BufferSize: 100}
+	d, err := OpenDynamicTree(dir, 2, 4, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 250; i++ {
+		err = d.Add(NewPoint(2, 4))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a merge that crashed after writing its new level but before
+	// replacing the manifest leaves the new level file and temporary files
+	// behind.
+	live, err := filepath.Glob(filepath.Join(dir, "level-*.tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range live {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(
+			filepath.Join(dir, "level-"+filepath.Base(tempName(dir))+".tree"),
+			data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.MkdirAll(filepath.Join(tempName(filepath.Join(dir, "tmp")), "tmp"),
+		0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// files that aren't part of the tree are left alone.
+	err = ioutil.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = OpenDynamicTree(dir, 2, 4, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.Count() != 250 {
+		t.Fatalf("got count %d after a crashed merge, expected 250", d.Count())
+	}
+	left, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != len(before)+1 {
+		t.Fatalf("got %v, expected %v and notes.txt", left, before)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := filepath.Glob(filepath.Join(dir, "tmp", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmp) != 0 {
+		t.Fatalf("temporary files left behind: %v", tmp)
+	}
+}
+
+func TestDynamicTreeForeignDir(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dir := fs.Path("foreign")
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenDynamicTree(dir, 2, 4, nil)
+	if err == nil {
+		t.Fatal("expected error opening a non-empty directory with no manifest")
+	}
+	left, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || filepath.Base(left[0]) != "notes.txt" {
+		t.Fatalf("directory was modified: %v", left)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 3
+	tree, all := createTestTreeWithOptions(t, fs, dims, 10, 500,
+		&BuildOptions{BucketSize: 4})
+	defer tree.Close()
+
+	deleted := map[int]bool{}
+	for i := 0; i < 50; i++ {
+		count, err := tree.Delete(all[i*7])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Fatalf("deleted %d points, expected 1", count)
+		}
+		deleted[i*7] = true
+	}
+	count, err := tree.Delete(all[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("deleted %d points again, expected 0", count)
+	}
+	count, err = tree.DeleteFunc(func(p Point) bool { return p.Pos[0] < 0.1 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range all {
+		if p.Pos[0] < 0.1 {
+			deleted[i] = true
+		}
+	}
+	if tree.Deleted() != int64(len(deleted)) {
+		t.Fatalf("%d points deleted, expected %d", tree.Deleted(), len(deleted))
+	}
+
+	check := func(tree *Tree) {
+		for j := 0; j < 10; j++ {
+			q := NewPoint(dims, 10)
+			var distances []float64
+			for i := range all {
+				if !deleted[i] {
+					distances = append(distances, q.distanceSquared(&all[i]))
+				}
+			}
+			sort.Float64s(distances)
+
+			for _, search := range []func(Point, int) ([]PointDistance, error){
+				tree.Nearest, tree.NearestExhaustive} {
+				got, err := search(q, 10)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := range got {
+					if got[i].Distance != distances[i] {
+						t.Fatalf("result %d has distance %f, expected %f", i,
+							got[i].Distance, distances[i])
+					}
+				}
+			}
+		}
+	}
+	check(tree)
+
+	reopened, err := OpenTree(tree.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.Deleted() != int64(len(deleted)) {
+		t.Fatalf("%d points deleted after reopening, expected %d",
+			reopened.Deleted(), len(deleted))
+	}
+	check(reopened)
+
+	compacted, err := tree.Compact(fs.Temp(), fs.Temp(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compacted.Close()
+	if compacted.Count() != int64(len(all)-len(deleted)) ||
+		compacted.Deleted() != 0 {
+		t.Fatalf("compacted tree has %d points and %d deleted, expected %d and 0",
+			compacted.Count(), compacted.Deleted(), len(all)-len(deleted))
+	}
+	if !compacted.bucketed {
+		t.Fatal("compacted tree isn't bucketed like the original")
+	}
+	check(compacted)
+
+	fraction := float64(tree.Deleted()) / float64(tree.Count())
+	skipped, err := tree.CompactIfNeeded(fraction, fs.Temp(), fs.Temp(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != nil {
+		t.Fatal("compacted a tree with fewer deletions than the threshold")
+	}
+	compacted, err = tree.CompactIfNeeded(fraction/2, fs.Temp(), fs.Temp(),
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compacted == nil {
+		t.Fatal("didn't compact a tree with more deletions than the threshold")
+	}
+	defer compacted.Close()
+	check(compacted)
+
+	// points of a normalized tree can be deleted as they were added or as
+	// they are returned, and compacting keeps the tree normalized.
+	normalized, points := createTestTreeWithOptions(t, fs, dims, 10, 100,
+		&BuildOptions{Normalize: true})
+	defer normalized.Close()
+	count, err = normalized.Delete(points[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("deleted %d points as added, expected 1", count)
+	}
+	nearest, err := normalized.NearestCosine(points[1], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err = normalized.Delete(nearest[0].Point)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("deleted %d points as returned, expected 1", count)
+	}
+	compacted, err = normalized.Compact(fs.Temp(), fs.Temp(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compacted.Close()
+	if !compacted.Normalized() || compacted.Count() != 98 {
+		t.Fatalf("compacted tree has %d points and normalized %v, expected 98 "+
+			"and true", compacted.Count(), compacted.Normalized())
+	}
+	nearest, err = compacted.NearestCosine(points[2], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearest) != 1 || !bytes.Equal(nearest[0].Data, points[2].Data) {
+		t.Fatalf("got %v, expected point 2", nearest)
+	}
+}
+
+func TestDeleteStaleTombstones(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 2
+	create := func(path string) *Tree {
+		log, err := NewPointSet(fs.Temp(), dims, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer log.Close()
+		for i := 0; i < 100; i++ {
+			err = log.Add(NewPoint(dims, 4))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		tree, err := CreateTree(path, fs.Temp(), log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tree
+	}
+	checkLive := func(tree *Tree, live int) {
+		if tree.Deleted() != int64(100-live) {
+			t.Fatalf("%d points deleted, expected %d", tree.Deleted(), 100-live)
+		}
+		nearest, err := tree.Nearest(NewPoint(dims, 4), 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nearest) != live {
+			t.Fatalf("got %d results, expected %d", len(nearest), live)
+		}
+	}
+
+	// rebuilding a tree at the same path drops its deletions.
+	path := fs.Path("rebuilt")
+	tree := create(path)
+	_, err = tree.DeleteFunc(func(Point) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLive(tree, 0)
+	err = tree.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree = create(path)
+	checkLive(tree, 100)
+	err = tree.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// so does compacting a tree and renaming the result over it.
+	path = fs.Path("compacted")
+	tree = create(path)
+	_, err = tree.DeleteFunc(func(p Point) bool { return p.Pos[0] < 0.5 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := 100 - int(tree.Deleted())
+	compacted, err := tree.Compact(fs.Path("compacted.new"), fs.Temp(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compacted.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tree.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(fs.Path("compacted.new"), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err = OpenTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if tree.Count() != int64(live) || tree.Deleted() != 0 {
+		t.Fatalf("compacted tree has %d points and %d deleted, expected %d "+
+			"and 0", tree.Count(), tree.Deleted(), live)
+	}
+
+	// and the stale tombstones are replaced by the first new deletion.
+	_, err = tree.DeleteFunc(func(Point) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.Deleted() != int64(live) {
+		t.Fatalf("%d points deleted after reopening, expected %d",
+			reopened.Deleted(), live)
+	}
+}
+
+func TestOpenPointSet(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 3
+	path := fs.Path("points")
+	var all []Point
+	for run := 0; run < 3; run++ {
+		log, err := OpenPointSet(path, dims, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if log.Count() != int64(len(all)) {
+			t.Fatalf("reopened with %d points, expected %d", log.Count(),
+				len(all))
+		}
+		for i := 0; i < 100; i++ {
+			p := NewPoint(dims, 10)
+			err = log.Add(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			all = append(all, p)
+		}
+
+		it, err := log.Iter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for it.Next() {
+			p := it.Point()
+			if !p.equal(&all[count]) {
+				t.Fatalf("point %d differs", count)
+			}
+			count++
+		}
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		if count != len(all) {
+			t.Fatalf("iterated over %d points, expected %d", count, len(all))
+		}
+		err = it.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a torn write at the end of the file is dropped
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fh.Write([]byte{0, 3, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	log, err := OpenPointSet(path, dims, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.Count() != int64(len(all)) {
+		t.Fatalf("reopened with %d points, expected %d", log.Count(), len(all))
+	}
+	tree, err := CreateTree(fs.Temp(), fs.Temp(), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if tree.Count() != int64(len(all)) {
+		t.Fatalf("tree has %d points, expected %d", tree.Count(), len(all))
+	}
+
+	_, err = OpenPointSet(path, dims+1, 10)
+	if err == nil {
+		t.Fatal("expected dimension mismatch error")
+	}
+}
+
+func TestCreateTreeFromStream(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 3
+	var all []Point
+	var serialized bytes.Buffer
+	for i := 0; i < 500; i++ {
+		p := NewPoint(dims, 10)
+		err = p.serialize(&serialized, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, p)
+	}
+	ctx := context.Background()
+
+	fromFunc := func() (*Tree, error) {
+		i := 0
+		return CreateTreeFromFunc(ctx, fs.Temp(), fs.Temp(), dims, 10,
+			func() (Point, error) {
+				if i >= len(all) {
+					return Point{}, io.EOF
+				}
+				i++
+				return all[i-1], nil
+			}, nil)
+	}
+	// a producer may reuse one point for everything it returns, so the
+	// sample of points that splits are chosen from must hold copies.
+	reused := func() (*Tree, error) {
+		i := 0
+		p := Point{Pos: make([]float64, dims), Data: make([]byte, 10)}
+		return CreateTreeFromFunc(ctx, fs.Temp(), fs.Temp(), dims, 10,
+			func() (Point, error) {
+				if i >= len(all) {
+					return Point{}, io.EOF
+				}
+				copy(p.Pos, all[i].Pos)
+				p.Data = append(p.Data[:0], all[i].Data...)
+				i++
+				return p, nil
+			}, nil)
+	}
+	fromReader := func() (*Tree, error) {
+		return CreateTreeFromReader(ctx, fs.Temp(), fs.Temp(), dims, 10,
+			bytes.NewReader(serialized.Bytes()), nil)
+	}
+	fromChan := func() (*Tree, error) {
+		ch := make(chan Point)
+		go func() {
+			for _, p := range all {
+				ch <- p
+			}
+			close(ch)
+		}()
+		return CreateTreeFromChan(ctx, fs.Temp(), fs.Temp(), dims, 10, ch,
+			nil)
+	}
+
+	for _, create := range []func() (*Tree, error){
+		fromFunc, reused, fromReader, fromChan} {
+		tree, err := create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tree.Count() != int64(len(all)) {
+			t.Fatalf("tree has %d points, expected %d", tree.Count(), len(all))
+		}
+		checkNearest(t, tree, dims, 10, 10)
+		err = tree.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = CreateTreeFromReader(ctx, fs.Temp(), fs.Temp(), dims, 10,
+		bytes.NewReader(serialized.Bytes()[:serialized.Len()-1]), nil)
+	if err == nil {
+		t.Fatal("expected error from truncated input")
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	log, err := NewPointSet(fs.Temp(), 2, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	count, err := ImportCSV(log, strings.NewReader(
+		"id\tx\ty\na\t1\t2\nb\t3.5\t-4e2\n"),
+		&CSVOptions{Comma: '\t', Header: true, Columns: []int{2, 3},
+			DataColumn: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || log.Count() != 2 {
+		t.Fatalf("imported %d points, expected 2", count)
+	}
+	it, err := log.Iter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	expected := []Point{
+		{Pos: []float64{1, 2}, Data: []byte("a")},
+		{Pos: []float64{3.5, -400}, Data: []byte("b")}}
+	for i := 0; it.Next(); i++ {
+		p := it.Point()
+		if !p.equal(&expected[i]) {
+			t.Fatalf("point %d is %v, expected %v", i, p, expected[i])
+		}
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+
+	for _, bad := range []string{
+		"1,2\n3\n",
+		"1,x\n",
+		"1,NaN\n",
+		"1,+Inf\n",
+		"1\n",
+	} {
+		_, err = ImportCSV(log, strings.NewReader(bad), nil)
+		if err == nil {
+			t.Fatalf("expected error importing %q", bad)
+		}
+	}
+	_, err = ImportCSV(log, strings.NewReader("1,2,toolongdata\n"),
+		&CSVOptions{DataColumn: 3})
+	if err == nil {
+		t.Fatal("expected error for long data")
+	}
+}
+
+func TestNPY(t *testing.T) {
+	fs, err := newBaseFS(tempName("/tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete()
+
+	dims := 3
+	tree, all := createTestTree(t, fs, dims, 10, 200)
+	defer tree.Close()
+	_, err = tree.Delete(all[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var points, ids bytes.Buffer
+	err = ExportNPY(tree, &points, &ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip through an .npz archive
+	var npz bytes.Buffer
+	zw := zip.NewWriter(&npz)
+	for name, data := range map[string][]byte{
+		"points.npy": points.Bytes(), "ids.npy": ids.Bytes()} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := NewPointSet(fs.Temp(), dims, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	count, err := ImportNPZ(log, bytes.NewReader(npz.Bytes()),
+		int64(npz.Len()), "points", "ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != int64(len(all)-1) {
+		t.Fatalf("imported %d points, expected %d", count, len(all)-1)
+	}
+
+	var exported []Point
+	err = tree.scan(context.Background(), func(p Point) error {
+		exported = append(exported, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := log.Iter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	for i := 0; it.Next(); i++ {
+		p := it.Point()
+		expected := exported[i]
+		// byte strings lose trailing NULs
+		expected.Data = bytes.TrimRight(expected.Data, "\x00")
+		if !p.equal(&expected) {
+			t.Fatalf("point %d is %v, expected %v", i, p, expected)
+		}
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	imported, err := CreateTree(fs.Temp(), fs.Temp(), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imported.Close()
+	if imported.Count() != count {
+		t.Fatalf("imported tree has %d points, expected %d", imported.Count(),
+			count)
+	}
+
+	// float32 points with int64 ids, as NumPy writes them
+	var f32, i64 bytes.Buffer
+	writeNPY := func(buf *bytes.Buffer, header string, values ...interface{}) {
+		buf.WriteString("\x93NUMPY\x01\x00")
+		header += strings.Repeat(" ", 63-(10+len(header))%64) + "\n"
+		binary.Write(buf, binary.LittleEndian, uint16(len(header)))
+		buf.WriteString(header)
+		for _, v := range values {
+			binary.Write(buf, binary.LittleEndian, v)
+		}
+	}
+	writeNPY(&f32, "{'descr': '<f4', 'fortran_order': False, 'shape': (2, 3), }",
+		[]float32{1, 2, 3, 4.5, 5, 6})
+	writeNPY(&i64, "{'descr': '<i8', 'fortran_order': False, 'shape': (2,), }",
+		[]int64{-7, 1234567})
+	log2, err := NewPointSet(fs.Temp(), dims, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log2.Close()
+	count, err = ImportNPY(log2, &f32, &i64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("imported %d points, expected 2", count)
+	}
+	it2, err := log2.Iter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it2.Close()
+	expected := []Point{
+		{Pos: []float64{1, 2, 3}, Data: []byte("-7")},
+		{Pos: []float64{4.5, 5, 6}, Data: []byte("1234567")}}
+	for i := 0; it2.Next(); i++ {
+		p := it2.Point()
+		if !p.equal(&expected[i]) {
+			t.Fatalf("point %d is %v, expected %v", i, p, expected[i])
+		}
+	}
+	if it2.Err() != nil {
+		t.Fatal(it2.Err())
+	}
+
+	var wrongShape bytes.Buffer
+	writeNPY(&wrongShape,
+		"{'descr': '<f8', 'fortran_order': False, 'shape': (1, 2), }",
+		[]float64{1, 2})
+	_, err = ImportNPY(log2, &wrongShape, nil)
+	if err == nil {
+		t.Fatal("expected error for wrong shape")
+	}
+}